@@ -0,0 +1,99 @@
+package eval
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"sort"
+	"strings"
+)
+
+// Functions called for their side effects, whose results nobody wants echoed
+var sideEffectFuncs = map[string]bool{
+	"print": true, "println": true, "panic": true, "close": true, "delete": true, "copy": true,
+	"clear": true,
+}
+
+// With Options.AutoPrint, autoPrint wraps each bare expression at the top level of main in __p, so
+// that "2 + 3" prints 5 the way it would in other REPLs. With Options.CaptureValue, the last
+// statement of main, if it's such an expression, is wrapped in __value instead. Calls to print
+// functions, builtins used for their side effects, and gore's own helpers are left alone, as are
+// receives like "<-done". A call that returns nothing can't be told apart from one that does
+// without type checking, so it's wrapped anyway; the compiler then complains that it's "used as
+// value", and the caller retries with that line in skip. wrapped holds the lines (in the user's
+// input) of the expressions that were wrapped.
+func autoPrint(nonTopLevel string, skip map[int]bool, opts Options) (code string, wrapped map[int]bool) {
+	const prefix = "package main\nfunc main() {\n"
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", prefix+nonTopLevel+"\n}\n", 0)
+	if err != nil {
+		return nonTopLevel, nil // the compiler will explain the problem
+	}
+	type edit struct {
+		offset int
+		text   string
+	}
+	var edits []edit
+	wrapped = make(map[int]bool)
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Name.Name != "main" {
+			continue
+		}
+		for i, stmt := range fn.Body.List {
+			expr, ok := stmt.(*ast.ExprStmt)
+			if !ok || !echoable(expr.X) {
+				continue
+			}
+			line := fset.Position(expr.Pos()).Line
+			helper := "__p("
+			if opts.CaptureValue && i == len(fn.Body.List)-1 {
+				helper = "__value("
+			} else if !opts.AutoPrint {
+				continue
+			}
+			if skip[line] {
+				continue
+			}
+			wrapped[line] = true
+			edits = append(edits,
+				edit{fset.Position(expr.Pos()).Offset - len(prefix), helper},
+				edit{fset.Position(expr.End()).Offset - len(prefix), ")"})
+		}
+	}
+	// Apply the edits back to front, so the earlier offsets stay valid
+	sort.SliceStable(edits, func(i, j int) bool { return edits[i].offset > edits[j].offset })
+	for _, e := range edits {
+		nonTopLevel = nonTopLevel[:e.offset] + e.text + nonTopLevel[e.offset:]
+	}
+	return nonTopLevel, wrapped
+}
+
+// Whether the result of a bare expression is worth printing
+func echoable(x ast.Expr) bool {
+	switch x := x.(type) {
+	case *ast.UnaryExpr:
+		return x.Op != token.ARROW
+	case *ast.CallExpr:
+		switch fun := x.Fun.(type) {
+		case *ast.Ident:
+			return !sideEffectFuncs[fun.Name] && !strings.HasPrefix(fun.Name, "__")
+		case *ast.SelectorExpr:
+			if pkg, ok := fun.X.(*ast.Ident); ok && pkg.Name == "fmt" {
+				return !strings.HasPrefix(fun.Sel.Name, "Print") && !strings.HasPrefix(fun.Sel.Name, "Fprint")
+			}
+		}
+	}
+	return true
+}
+
+// The lines of wrapped expressions the compiler says have no value, and so shouldn't have been
+// wrapped after all
+func valuelessLines(err string, wrapped map[int]bool, source string) (lines []int) {
+	for _, e := range parseErrors(err, source) {
+		if wrapped[e.Line] && strings.Contains(e.Msg, "used as value") {
+			lines = append(lines, e.Line)
+		}
+	}
+	return lines
+}
@@ -0,0 +1,290 @@
+package eval
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"go/parser"
+	"go/token"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	cacheLock sync.Mutex
+	cacheDirs = make(map[string]string) // go binary -> cache directory, or "" if unusable
+)
+
+// Compiled binaries are cached in a per-toolchain directory under os.UserCacheDir. Upgrading
+// the default toolchain discards binaries built by the old version; directories of toolchains
+// chosen explicitly (see Options.GoBin) are left alone, since more than one may be in use.
+func binaryCacheDir(goBin string) string {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	if dir, ok := cacheDirs[goBin]; ok {
+		return dir
+	}
+	cacheDirs[goBin] = ""
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	out, err := exec.Command(goBin, "env", "GOVERSION").Output()
+	if err != nil {
+		return ""
+	}
+	version := strings.TrimSpace(string(out))
+	root := filepath.Join(base, "gore", "bin")
+	dir := filepath.Join(root, version)
+	if os.MkdirAll(dir, 0755) != nil {
+		return ""
+	}
+	if goBin == "go" {
+		entries, _ := os.ReadDir(root)
+		for _, entry := range entries {
+			if entry.Name() != version {
+				os.RemoveAll(filepath.Join(root, entry.Name())) // stale toolchain
+			}
+		}
+	}
+	cacheDirs[goBin] = dir
+	return dir
+}
+
+// Compile src to an executable, reusing the cached binary if the same source was compiled
+// before. cleanup removes the executable unless it belongs to the cache. If compilation fails,
+// err holds the compiler's output.
+func build(ctx context.Context, src string, opts Options) (bin string, cleanup func(), err string) {
+	tmpfile := save(src, opts)
+	if !opts.KeepTemp {
+		defer os.Remove(tmpfile)
+	}
+	cleanup = func() {}
+	goBin := goBinary(opts)
+	dir := ""
+	if opts.CacheSize > 0 && stdImportsOnly(src) {
+		dir = binaryCacheDir(goBin)
+	}
+	if dir != "" {
+		// The flags and target affect the binary as much as the source does, as do building it
+		// as a test, the directory it's built in and the environment the go command reads
+		key := buildDir(opts) + "\x00" + strings.Join(buildFlags(opts), "\x00") + "\x00" + opts.GOOS + "/" + opts.GOARCH + "\x00" +
+			strings.Join(opts.Tags, ",") + "\x00"
+		for _, name := range buildEnv {
+			key += name + "=" + os.Getenv(name) + "\x00"
+		}
+		key += src
+		if hasTests(src) {
+			key = "test\x00" + key
+		}
+		sum := sha256.Sum256([]byte(key))
+		bin = filepath.Join(dir, hex.EncodeToString(sum[:])+exeSuffix())
+		now := time.Now()
+		if os.Chtimes(bin, now, now) == nil { // cache hit; mark it recently used
+			return bin, cleanup, ""
+		}
+		// Build under a temporary name, so that a concurrent Eval never runs a partial binary
+		f, e := os.CreateTemp(dir, filepath.Base(bin)+".partial*")
+		if e != nil {
+			systemFailure("Unable to create binary in cache", e)
+		}
+		f.Close()
+		partial := f.Name()
+		if err = compile(ctx, partial, tmpfile, opts); err != "" {
+			os.Remove(partial)
+			return "", cleanup, err
+		}
+		if os.Rename(partial, bin) == nil {
+			evict(dir, opts.CacheSize)
+			return bin, cleanup, ""
+		}
+		return partial, func() { os.Remove(partial) }, ""
+	}
+
+	tmpdir, e := os.MkdirTemp("", "gore_bin")
+	if e != nil {
+		systemFailure("Unable to create build directory", e)
+	}
+	cleanup = func() { os.RemoveAll(tmpdir) }
+	bin = filepath.Join(tmpdir, "gore_eval"+exeSuffix())
+	if err = compile(ctx, bin, tmpfile, opts); err != "" {
+		cleanup()
+		return "", func() {}, err
+	}
+	return bin, cleanup, ""
+}
+
+// Environment variables that change what the go command builds from the same source
+var buildEnv = []string{"GOFLAGS", "CGO_ENABLED", "GOEXPERIMENT"}
+
+// The directory the go command runs in, and so the module, if any, it builds in
+func buildDir(opts Options) string {
+	if opts.ModuleDir != "" {
+		dir, _ := filepath.Abs(opts.ModuleDir)
+		return dir
+	}
+	dir, _ := os.Getwd()
+	return dir
+}
+
+// Whether src imports only the standard library (and perhaps "C"). Other packages come from a
+// module or GOPATH whose contents may change without src changing, so such a program isn't cached.
+func stdImportsOnly(src string) bool {
+	f, err := parser.ParseFile(token.NewFileSet(), "", src, parser.ImportsOnly)
+	if err != nil {
+		return false
+	}
+	for _, spec := range f.Imports {
+		path, _ := strconv.Unquote(spec.Path.Value)
+		if path != "C" && !isStdPackage(path) {
+			return false
+		}
+	}
+	return true
+}
+
+// Compile src, discarding the result. This is all there is to do with a package other than main.
+func compileOnly(ctx context.Context, src string, opts Options) (err string) {
+	tmpfile := save(src, opts)
+	if !opts.KeepTemp {
+		defer os.Remove(tmpfile)
+	}
+	return compile(ctx, os.DevNull, tmpfile, opts)
+}
+
+// Vet src, returning what go vet finds, if anything
+func vet(ctx context.Context, src string, opts Options) (warnings []EvalError) {
+	tmpfile := save(src, opts)
+	if !opts.KeepTemp {
+		defer os.Remove(tmpfile)
+	}
+	args := []string{"vet"}
+	if len(opts.Tags) > 0 {
+		args = append(args, "-tags", strings.Join(opts.Tags, ","))
+	}
+	out, _ := goCommand(ctx, opts, append(args, tmpfile)...).CombinedOutput()
+	// vet leaves out the colon before a position without a file name
+	return parseErrors(vetPosPat.ReplaceAllString(string(out), ":$1"), opts.SourceName)
+}
+
+var vetPosPat = regexp.MustCompile(`(?m)^(\d+(?::\d+)?: )`)
+
+// The go command, set up to build for the platform in opts
+func goCommand(ctx context.Context, opts Options, args ...string) *exec.Cmd {
+	goBin := goBinary(opts)
+	if _, e := exec.LookPath(goBin); e != nil {
+		// Otherwise the error from exec would be taken for compiler output
+		systemFailure("go toolchain not found in PATH", e)
+	}
+	cmd := command(ctx, goBin, args...)
+	cmd.Dir = opts.ModuleDir
+	if opts.GOOS != "" || opts.GOARCH != "" {
+		cmd.Env = os.Environ()
+		if opts.GOOS != "" {
+			cmd.Env = append(cmd.Env, "GOOS="+opts.GOOS)
+		}
+		if opts.GOARCH != "" {
+			cmd.Env = append(cmd.Env, "GOARCH="+opts.GOARCH)
+		}
+	}
+	return cmd
+}
+
+func compile(ctx context.Context, bin string, tmpfile string, opts Options) (err string) {
+	args := []string{"build"}
+	if strings.HasSuffix(tmpfile, "_test.go") { // see save
+		args = []string{"test", "-c"}
+	}
+	if len(opts.Tags) > 0 {
+		args = append(args, "-tags", strings.Join(opts.Tags, ","))
+	}
+	args = append(args, buildFlags(opts)...)
+	args = append(args, "-o", bin, tmpfile)
+	out, e := goCommand(ctx, opts, args...).CombinedOutput()
+	if e != nil && len(out) == 0 {
+		return e.Error() + "\n" // e.g. the go command isn't there
+	} else if e != nil {
+		return string(out)
+	}
+	return ""
+}
+
+// Options.BuildFlags, with -race added for Options.Race unless it's there already
+func buildFlags(opts Options) []string {
+	if !opts.Race {
+		return opts.BuildFlags
+	}
+	for _, flag := range opts.BuildFlags {
+		if flag == "-race" || flag == "-race=true" {
+			return opts.BuildFlags
+		}
+	}
+	return append(append([]string(nil), opts.BuildFlags...), "-race")
+}
+
+// Copy the binary to path, which may be in the cache or about to be removed, returning path
+func keepBinary(bin string, path string) string {
+	in, e := os.Open(bin)
+	if e != nil {
+		systemFailure("Unable to read binary", e)
+	}
+	defer in.Close()
+	out, e := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if e != nil {
+		systemFailure("Unable to keep binary", e)
+	}
+	if _, e = io.Copy(out, in); e == nil {
+		e = out.Close()
+	} else {
+		out.Close()
+	}
+	if e != nil {
+		systemFailure("Unable to keep binary", e)
+	}
+	return path
+}
+
+// Keep only the size most recently used binaries in dir. Binaries still being built are left alone.
+func evict(dir string, size int) {
+	entries, _ := os.ReadDir(dir)
+	var binaries []os.FileInfo
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil && !strings.Contains(entry.Name(), ".partial") {
+			binaries = append(binaries, info)
+		}
+	}
+	if len(binaries) <= size {
+		return
+	}
+	sort.Slice(binaries, func(i, j int) bool { return binaries[i].ModTime().After(binaries[j].ModTime()) })
+	for _, info := range binaries[size:] {
+		os.Remove(filepath.Join(dir, info.Name()))
+	}
+}
+
+// The go command to use: Options.GoBin, else $GORE_GO, else whichever "go" is in the PATH
+func goBinary(opts Options) string {
+	if opts.GoBin != "" {
+		return opts.GoBin
+	}
+	if goBin := os.Getenv("GORE_GO"); goBin != "" {
+		return goBin
+	}
+	return "go"
+}
+
+func exeSuffix() string {
+	if runtime.GOOS == "windows" {
+		return ".exe"
+	}
+	return ""
+}
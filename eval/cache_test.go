@@ -0,0 +1,45 @@
+package eval
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBinaryCache(t *testing.T) {
+	opts := DefaultOptions()
+	opts.CacheSize = 2
+	nonce := time.Now().UnixNano() // make sure the first round has to compile
+	for i := 0; i < 2; i++ {       // the second round runs the cached binaries
+		for _, word := range []string{"one", "two", "three"} {
+			word = fmt.Sprint(word, nonce)
+			out, errs := evalCode(context.Background(), `p "`+word+`"`, opts)
+			if strings.TrimSpace(out) != word || errs != nil {
+				t.Errorf("Expected %s, got %q and %v", word, out, errs)
+			}
+		}
+	}
+	dir := binaryCacheDir(goBinary(opts))
+	if dir == "" {
+		t.Skip("no cache directory")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) > 2 {
+		t.Errorf("Expected at most 2 cached binaries, found %d", len(entries))
+	}
+}
+
+func TestBuildFlags(t *testing.T) {
+	opts := DefaultOptions()
+	opts.BuildFlags = []string{"-trimpath"}
+	opts.Race = true
+	if flags := strings.Join(buildFlags(opts), " "); flags != "-trimpath -race" {
+		t.Errorf("Expected -race to be added, got %q", flags)
+	}
+	opts.BuildFlags = []string{"-race"}
+	if flags := strings.Join(buildFlags(opts), " "); flags != "-race" {
+		t.Errorf("Expected -race only once, got %q", flags)
+	}
+}
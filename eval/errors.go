@@ -0,0 +1,121 @@
+package eval
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// An EvalError is a single diagnostic produced while evaluating a snippet.
+// Line and Col refer to the user's original input, courtesy of the "//line"
+// pragmas that partition embeds in the generated source. Either is 0 when the
+// compiler did not report it.
+type EvalError struct {
+	File string // Options.SourceName, if the error is in the snippet and it has a name
+	Line int
+	Col  int
+	Msg  string
+	Kind ErrorKind
+}
+
+// ErrorKind tells what went wrong
+type ErrorKind int
+
+const (
+	// The snippet couldn't be parsed or compiled
+	CompileError ErrorKind = iota
+	// The program ran, but panicked or exited with a non-zero status. Msg is its output (a panic's
+	// stack trace, say) exactly as printed, followed by the exit status; Line is 0.
+	RuntimeError
+	// The snippet couldn't be evaluated because of a problem with the environment, such as a temp
+	// file that couldn't be written; Line is 0.
+	SystemError
+	// The snippet ends in the middle of something, such as an unclosed bracket or raw string, so
+	// more lines might complete it. Line is where the unfinished part begins. Such an error is
+	// ErrIncomplete, as far as errors.Is is concerned.
+	IncompleteError
+)
+
+// ErrIncomplete matches the EvalErrors for snippets that are unfinished rather than wrong (see
+// IncompleteError). A REPL can keep reading lines until a snippet isn't incomplete any more;
+// too many closing brackets, on the other hand, are an error no further input can fix.
+var ErrIncomplete = errors.New("incomplete input: more lines needed")
+
+// Is reports whether e is an IncompleteError, when target is ErrIncomplete
+func (e EvalError) Is(target error) bool {
+	return target == ErrIncomplete && e.Kind == IncompleteError
+}
+
+func (e EvalError) Error() string {
+	switch {
+	case e.Line == 0:
+		return e.Msg
+	case e.Col == 0:
+		return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+	default:
+		return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Col, e.Msg)
+	}
+}
+
+// EvalErrors are all the errors from a single evaluation, as an error
+type EvalErrors []EvalError
+
+func (errs EvalErrors) Error() string {
+	return strings.TrimSuffix(joinErrors(errs), "\n")
+}
+
+// joinErrors renders errs in the plain-text form returned by Eval, one error per line
+func joinErrors(errs []EvalError) string {
+	s := ""
+	for _, e := range errs {
+		s += e.Error() + "\n"
+	}
+	return s
+}
+
+// Compiler diagnostics look like "file:line:col: msg". Because of the "//line :nnn" pragmas, the
+// file name is empty for errors in user code, and the column is usually absent. Older compilers
+// also emitted a bracketed position in the generated file, as in ":12[/tmp/gore_eval.go:30]: msg"
+var diagPat = regexp.MustCompile(`^(.*?):(\d+)(?::(\d+))?(?:\[.*\])?: (.*)$`)
+
+// Split compiler output into individual errors. Only positions without a file name are
+// attributed to the user's input; positions in the generated file (imports, helpers) are dropped
+// since they mean nothing to the user; positions in other files, such as the prelude and those
+// given to EvalFiles, are kept in the message. Indented lines continue the previous error. If the
+// snippet has a source name (see Options.SourceName), positions in a file of that name are the
+// user's as well.
+func parseErrors(output string, source string) (errs []EvalError) {
+	for _, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "# ") {
+			continue
+		}
+		if strings.HasPrefix(line, "\t") && len(errs) > 0 {
+			errs[len(errs)-1].Msg += "\n" + line
+			continue
+		}
+		m := diagPat.FindStringSubmatch(line)
+		if m == nil {
+			errs = append(errs, EvalError{Msg: line})
+			continue
+		}
+		e := EvalError{Msg: m[4]}
+		switch {
+		case m[1] == "":
+			e.Line, _ = strconv.Atoi(m[2])
+			e.Col, _ = strconv.Atoi(m[3])
+		case source != "" && filepath.Base(m[1]) == filepath.Base(source):
+			// The compiler may have shortened the name, relative to its own directory
+			e.File = source
+			e.Line, _ = strconv.Atoi(m[2])
+			e.Col, _ = strconv.Atoi(m[3])
+		case !strings.HasPrefix(filepath.Base(m[1]), "gore_eval"): // see save
+			// The name is made relative to the generated file's directory
+			e.Msg = filepath.Base(m[1]) + ":" + m[2] + ": " + e.Msg
+		}
+		errs = append(errs, e)
+	}
+	return errs
+}
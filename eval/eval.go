@@ -6,58 +6,144 @@ package eval
 */
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/theclapp/gore/scanner"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
 	"io"
 	"os"
 	"os/exec"
 	"path"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 var (
+	stdOnce sync.Once
+	// package name -> import path, for the standard library. See builtinPackages
 	builtinPkgs map[string]string
+	// package name -> import paths, for names shared by several standard packages. The path in
+	// builtinPkgs comes first; the others are tried in turn by switchVariant.
+	stdVariants map[string][]string
+	// every import path in the standard library
+	stdPaths map[string]bool
 )
 
-func init() {
-	builtinPkgs = make(map[string]string)
-	pkgs := []string{
-		"hash/adler32", "crypto/aes", "encoding/ascii85", "encoding/asn1",
-		"go/ast", "sync/atomic", "encoding/base32", "encoding/base64",
-		"math/big", "encoding/binary", "bufio", "go/build",
-		"bytes", "compress/bzip2", "net/http/cgi", "runtime/cgo",
-		"crypto/cipher", "math/cmplx", "image/color", "hash/crc32",
-		"hash/crc64", "crypto", "encoding/csv", "runtime/debug",
-		"crypto/des", "go/doc", "image/draw", "database/sql/driver",
-		"crypto/dsa", "debug/dwarf", "crypto/ecdsa", "debug/elf",
-		"crypto/elliptic", "errors", "os/exec", "expvar",
-		"net/http/fcgi", "path/filepath", "flag", "compress/flate",
-		"fmt", "hash/fnv", "image/gif", "encoding/gob",
-		"debug/gosym", "compress/gzip", "hash", "container/heap",
-		"encoding/hex", "crypto/hmac", "html", "net/http",
-		"net/http/httputil", "image", "io", "io/ioutil",
-		"image/jpeg", "encoding/json", "net/rpc/jsonrpc", "container/list",
-		"log", "compress/lzw", "debug/macho", "net/mail",
-		"math", "crypto/md5", "mime", "mime/multipart",
-		"net", "os", "text/template/parse", "go/parser",
-		"path", "debug/pe", "encoding/pem", "crypto/x509/pkix",
-		"image/png", "net/http/pprof", "go/printer",
-		"math/rand", "crypto/rc4", "reflect",
-		"regexp", "container/ring", "net/rpc", "crypto/rsa",
-		"runtime", "text/scanner", "crypto/sha1",
-		"crypto/sha256", "crypto/sha512", "os/signal", "net/smtp",
-		"sort", "database/sql", "strconv", "strings",
-		"crypto/subtle", "index/suffixarray", "sync", "regexp/syntax",
-		"syscall", "log/syslog", "text/tabwriter", "archive/tar",
-		"text/template", "net/textproto", "time",
-		"crypto/tls", "go/token", "unicode", "unsafe",
-		"net/url", "os/user", "unicode/utf16", "unicode/utf8",
-		"crypto/x509", "encoding/xml", "archive/zip", "compress/zlib",
-	}
-
-	for _, pkg := range pkgs {
-		builtinPkgs[pkg[strings.LastIndex(pkg, "/")+1:]] = pkg
+// The standard packages gore has always known about. Where several share a name (math/rand and
+// crypto/rand, say), the one listed here is the one a snippet gets first.
+var knownStdPkgs = []string{
+	"hash/adler32", "crypto/aes", "encoding/ascii85", "encoding/asn1",
+	"go/ast", "sync/atomic", "encoding/base32", "encoding/base64",
+	"math/big", "encoding/binary", "bufio", "go/build",
+	"bytes", "compress/bzip2", "net/http/cgi", "runtime/cgo",
+	"crypto/cipher", "math/cmplx", "image/color", "hash/crc32",
+	"hash/crc64", "crypto", "encoding/csv", "runtime/debug",
+	"crypto/des", "go/doc", "image/draw", "database/sql/driver",
+	"crypto/dsa", "debug/dwarf", "crypto/ecdsa", "debug/elf",
+	"crypto/elliptic", "errors", "os/exec", "expvar",
+	"net/http/fcgi", "path/filepath", "flag", "compress/flate",
+	"fmt", "hash/fnv", "image/gif", "encoding/gob",
+	"debug/gosym", "compress/gzip", "hash", "container/heap",
+	"encoding/hex", "crypto/hmac", "html", "net/http",
+	"net/http/httputil", "image", "io", "io/ioutil",
+	"image/jpeg", "encoding/json", "net/rpc/jsonrpc", "container/list",
+	"log", "compress/lzw", "debug/macho", "net/mail",
+	"math", "crypto/md5", "mime", "mime/multipart",
+	"net", "os", "text/template/parse", "go/parser",
+	"path", "debug/pe", "encoding/pem", "crypto/x509/pkix",
+	"image/png", "net/http/pprof", "go/printer",
+	"math/rand", "crypto/rc4", "reflect",
+	"regexp", "container/ring", "net/rpc", "crypto/rsa",
+	"runtime", "text/scanner", "crypto/sha1",
+	"crypto/sha256", "crypto/sha512", "os/signal", "net/smtp",
+	"sort", "database/sql", "strconv", "strings",
+	"crypto/subtle", "index/suffixarray", "sync", "regexp/syntax",
+	"syscall", "log/syslog", "text/tabwriter", "archive/tar",
+	"text/template", "net/textproto", "time",
+	"crypto/tls", "go/token", "unicode", "unsafe",
+	"net/url", "os/user", "unicode/utf16", "unicode/utf8",
+	"crypto/x509", "encoding/xml", "archive/zip", "compress/zlib",
+}
+
+// Return the standard library packages, keyed by package name. Besides knownStdPkgs, these are
+// whatever else "go list std" reports, so that packages added by newer releases (slices, maps,
+// log/slog, ...) are found too; a name shared by several of those is left out. If "go list"
+// fails, knownStdPkgs is all there is.
+func builtinPackages() map[string]string {
+	stdOnce.Do(func() {
+		builtinPkgs, stdVariants, stdPaths = make(map[string]string), make(map[string][]string), make(map[string]bool)
+		for _, pkg := range knownStdPkgs {
+			builtinPkgs[pkgName(pkg)] = pkg
+			stdPaths[pkg] = true
+		}
+		out, err := exec.Command(goBinary(Options{}), "list", "-f", "{{.Name}} {{.ImportPath}}", "std").Output()
+		if err != nil {
+			return
+		}
+		addStdPackages(string(out))
+	})
+	return builtinPkgs
+}
+
+// Parse lines of the form "name importpath" from "go list std"
+func addStdPackages(list string) {
+	found := make(map[string][]string)
+	for _, line := range strings.Split(list, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		name, path := fields[0], fields[1]
+		stdPaths[path] = true
+		if name == "main" || strings.Contains("/"+path+"/", "/internal/") || strings.HasPrefix(path, "vendor/") {
+			continue
+		}
+		found[name] = append(found[name], path)
+	}
+	for name, paths := range found {
+		chosen, ok := builtinPkgs[name]
+		if !ok && len(paths) == 1 {
+			builtinPkgs[name] = paths[0]
+		}
+		if !ok || len(paths) == 1 {
+			continue
+		}
+		sort.Strings(paths)
+		variants := []string{chosen}
+		for _, path := range paths {
+			if path != chosen {
+				variants = append(variants, path)
+			}
+		}
+		stdVariants[name] = variants
+	}
+}
+
+// Whether path is a standard library package
+func isStdPackage(path string) bool {
+	builtinPackages()
+	return stdPaths[path]
+}
+
+// BuiltinPackages returns the standard library packages Eval imports automatically, keyed by the
+// name a snippet refers to them by; e.g. "rand" maps to "math/rand". The map is a copy, and
+// changing it has no effect on Eval.
+func BuiltinPackages() map[string]string {
+	pkgs := make(map[string]string, len(builtinPackages()))
+	for name, path := range builtinPackages() {
+		pkgs[name] = path
 	}
+	return pkgs
 }
 
 // Eval "evaluates" a multi-line bit of go code by compiling and running it. It
@@ -77,66 +163,288 @@ func init() {
 // `)
 // This should return:
 //     Eval demo
-//     a =  {The answer is 42}
+//     a =
+//     {S:The answer is V:42}
 //     The answer is: 42
+// since p prints each value on a line of its own. With Options.PrintInline set, the second and
+// third lines are printed as one, "a =  {S:The answer is V:42}".
 //
-// 1. A line of the form "p XXX" is translated to _p(XXX), where _p is an embedded function (see buildMain)
+// 1. A line of the form "p XXX" is translated to __p(XXX), where __p is an embedded function (see buildMain)
 // 2. There is no need to import standard go packages. They are inferred
 //    and imported automatically. (e.g. "fmt" in the code above)
 // 3. The code is automatically wrapped inside a main package and a main function.
 //    Statements are internally reordered, so that import blocks, type declaration blocks and funcs
 //    are pulled to the "top level"; i.e precede the other statements. The remaining statements and blocks
 //    are bundled inside a main function.
-// To examine the generated code, set the envvar TMPDIR or TEMPDIR, and see $TMPDIR/gore_eval.go
+// 4. Code that begins with a package clause is compiled as is, and run only if it's package main.
+//    For any other package, out and err are both empty if it compiles.
+// 5. If the code declares test functions, such as "func TestFoo(t *testing.T)", they are run as
+//    "go test -v" would, instead of main. Benchmarks, "func BenchmarkFoo(b *testing.B)", are run
+//    too, as with "go test -bench=. -benchmem".
+// To examine the generated code, call Generate, or set the envvar TMPDIR or TEMPDIR, and see $TMPDIR/gore_eval.go
 
 func Eval(code string) (out string, err string) {
+	return EvalContext(context.Background(), code)
+}
+
+// EvalContext is like Eval, but the evaluation (compilation and the running program) is killed
+// if ctx is cancelled or its deadline expires. In that case err says the evaluation was cancelled.
+func EvalContext(ctx context.Context, code string) (out string, err string) {
+	out, errs := evalCode(ctx, code, DefaultOptions())
+	return out, joinErrors(errs)
+}
+
+// EvalWithOptions is like Eval, with the conveniences configured by opts.
+func EvalWithOptions(code string, opts Options) (out string, err string) {
+	out, errs := evalCode(context.Background(), code, opts)
+	return out, joinErrors(errs)
+}
+
+// EvalWithImports is like Eval, but also imports the given packages, which are keyed by the
+// name to import them as ("" for the package's own name). Use this for packages that inference
+// can't find. Like inferred ones, they are dropped if they turn out to be unused.
+func EvalWithImports(code string, imports map[string]string) (out string, err string) {
+	opts := DefaultOptions()
+	opts.Imports = imports
+	return EvalWithOptions(code, opts)
+}
+
+// EvalBytes is like Eval, for servers that evaluate many snippets with a lot of output: the
+// program writes its output straight into the returned slice, rather than into a string that
+// would be copied again. The snippet itself is still converted to a string, since it's copied
+// anyway while the program is generated.
+func EvalBytes(code []byte) (out []byte, errOut []byte) {
+	var buf bytes.Buffer
+	opts := DefaultOptions()
+	opts.Stdout, opts.Stderr = &buf, &buf
+	res := Evaluate(context.Background(), string(code), opts)
+	switch {
+	case len(res.Errors) > 0:
+		return nil, []byte(joinErrors(res.Errors))
+	case res.ExitCode != 0 && res.ExitCode != NotRun: // as in outputAndErrors
+		return nil, fmt.Appendf(buf.Bytes(), "exit status %d\n", res.ExitCode)
+	}
+	return buf.Bytes(), nil
+}
+
+// EvalStructured is like Eval, but returns each compiler error as a separate EvalError
+// instead of a single blob of text. Line numbers refer to the user's input.
+func EvalStructured(code string) (out string, errs []EvalError) {
+	return evalCode(context.Background(), code, DefaultOptions())
+}
+
+// EvalStream is like Eval, but the program's output is written to stdout and stderr as it's
+// produced, rather than returned when it's done. If the snippet doesn't compile, or the program
+// fails, err is an EvalErrors; the output of a failed program has gone to the writers already.
+func EvalStream(code string, stdout, stderr io.Writer) error {
+	opts := DefaultOptions()
+	opts.Stdout, opts.Stderr = stdout, stderr
+	if _, errs := evalCode(context.Background(), code, opts); errs != nil {
+		return EvalErrors(errs)
+	}
+	return nil
+}
+
+// EvalFiles is like Eval, but evaluates several snippets, keyed by file name, as a single
+// program, the way the files of a package compile together. Their declarations are combined,
+// and the rest of each runs in main, in the order of the file names. Imports are inferred across
+// all of them. Errors in a file are reported as "name:line: msg".
+func EvalFiles(files map[string]string) (out string, err string) {
+	out, errs := evaluateFiles(context.Background(), files, DefaultOptions()).outputAndErrors()
+	return out, joinErrors(errs)
+}
+
+var linePragmaPat = regexp.MustCompile(`(?m)^//line :(\d+)$`)
+
+func evaluateFiles(ctx context.Context, files map[string]string, opts Options) (res EvalResult) {
 	defer func() { // error recovery
 		if e := recover(); e != nil {
-			out = ""
-			err = fmt.Sprintf("1:%v", e)
+			res = EvalResult{Errors: []EvalError{recovered(e)}, ExitCode: NotRun}
 		}
 	}()
+	opts = withFetchModule(opts)
 
-	// No additional wrapping if it has a package declaration already
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var topLevel, nonTopLevel string
+	pkgsToImport := make(map[string]string)
+	// The files' own imports are pooled, so that two of them can import the same package
+	declared := make(map[string]string)
+	for _, name := range names {
+		var code string
+		code, opts = applyDirectives(stripShebang(files[name]), opts)
+		code, imports := importDecls(expandAliases(code, opts.Aliases))
+		top, main, pkgs, e := partition(code, opts.ModuleDir)
+		if e != nil {
+			err := asEvalError(e)
+			if err.Line > 0 {
+				err.Msg, err.Line = fmt.Sprintf("%s:%d: %s", name, err.Line, err.Msg), 0
+			}
+			return EvalResult{Errors: []EvalError{err}, ExitCode: NotRun}
+		}
+		// Make the "//line" pragmas refer to the file (see parseErrors)
+		topLevel += linePragmaPat.ReplaceAllString(top, "//line "+name+":$1")
+		nonTopLevel += linePragmaPat.ReplaceAllString(main, "//line "+name+":$1")
+		for path, alias := range pkgs {
+			pkgsToImport[path] = alias
+		}
+		for alias, path := range imports {
+			declared[alias] = path
+		}
+	}
+	forced := make(map[string]string)
+	for _, m := range []map[string]string{opts.Imports, declared} {
+		for name, path := range m {
+			forced[name] = path
+		}
+	}
+	opts.Imports = forced
+	opts.SourceName = "" // each file has a name of its own
+	res, err := buildAndExec(ctx, topLevel, nonTopLevel, pkgsToImport, opts)
+	if err != "" {
+		res.Errors = parseErrors(err, "")
+	}
+	return res
+}
+
+// Check compiles code the way Eval would, inferring and repairing its imports, but doesn't run
+// it, so it has no side effects. It returns the compiler's errors, if any.
+func Check(code string) (errs []EvalError) {
+	opts := DefaultOptions()
+	opts.CompileOnly = true
+	return Evaluate(context.Background(), code, opts).Errors
+}
+
+// Generate returns the program that Eval would compile for code, without compiling or running
+// it. This is the source Eval saves in gore_eval.go.
+func Generate(code string) (src string, err error) {
+	defer func() { // error recovery
+		if e := recover(); e != nil {
+			src, err = "", recovered(e)
+		}
+	}()
+
+	code = stripShebang(code)
 	if ok, _ := regexp.MatchString(`^\s*package `, code); ok {
-		out, err = run(code)
-		return out, err
+		return code, nil
 	}
+	code, opts := applyDirectives(code, DefaultOptions())
+	code, cgo := cgoPreamble(code)
+	code = expandAliases(code, opts.Aliases)
+	topLevel, nonTopLevel, pkgsToImport, err := partition(code, "")
+	if err != nil {
+		return "", err
+	}
+	addImports(pkgsToImport, opts.Imports)
+	return buildMain(cgo+topLevel, nonTopLevel, pkgsToImport, opts), nil
+}
 
-	code = expandAliases(code)
-	topLevel, nonTopLevel, pkgsToImport := partition(code)
-	return buildAndExec(topLevel, nonTopLevel, pkgsToImport)
+// Convert a value recovered from a panic during evaluation into an error
+func recovered(e interface{}) EvalError {
+	if err, ok := e.(EvalError); ok { // see systemFailure
+		return err
+	}
+	return EvalError{Line: 1, Msg: fmt.Sprint(e)}
 }
 
-// A Chunk is a stretch of text, and is either a comment or a string (possibly multiline), or text by default
+// Abandon the evaluation because of a problem that's not the snippet's fault, such as a temp
+// file that can't be written. Evaluate recovers, and returns it as a SystemError.
+func systemFailure(msg string, err error) {
+	panic(EvalError{Msg: msg + ": " + err.Error(), Kind: SystemError})
+}
 
-// Chunk kind
-const (
-	KSTRING = iota + 1
-	KCOMMENT
-	KTEXT
-)
+func asEvalError(err error) EvalError {
+	if e, ok := err.(EvalError); ok {
+		return e
+	}
+	return EvalError{Msg: err.Error()}
+}
+
+func evalCode(ctx context.Context, code string, opts Options) (out string, errs []EvalError) {
+	return Evaluate(ctx, code, opts).outputAndErrors()
+}
+
+// Blank out a "#!" line at the very start of a script, as in "#!/usr/bin/env gore", which isn't
+// Go. The line is left empty rather than removed, so the line numbers of the rest don't change.
+// A byte order mark before it, as some Windows editors write, is dropped as well.
+func stripShebang(code string) string {
+	code = strings.TrimPrefix(code, "\uFEFF")
+	if !strings.HasPrefix(code, "#!") {
+		return code
+	}
+	if i := strings.IndexByte(code, '\n'); i >= 0 {
+		return code[i:]
+	}
+	return ""
+}
 
-type Chunk struct {
-	kind  int    // One of the chunk kinds above
-	text  string // slice of input string
-	numNL int    // number of new lines embedded in text
+var packagePat = regexp.MustCompile(`^\s*package\s+(\w+)`)
+
+// Evaluate is the most general form of Eval. It evaluates code with the given options, until ctx
+// is done, and reports everything there is to know about the outcome.
+func Evaluate(ctx context.Context, code string, opts Options) (res EvalResult) {
+	defer func() { // error recovery
+		if e := recover(); e != nil {
+			res = EvalResult{Errors: []EvalError{recovered(e)}, ExitCode: NotRun}
+		}
+	}()
+	opts = withFetchModule(opts)
+
+	var err string
+	code = stripShebang(code)
+	// No additional wrapping if it has a package declaration already
+	if m := packagePat.FindStringSubmatch(code); m != nil {
+		if m[1] != "main" && !hasTests(code) {
+			opts.CompileOnly = true // nothing to run; just see whether it compiles
+		}
+		if opts.SourceName != "" {
+			code = "//line " + opts.SourceName + ":1\n" + code
+		}
+		res, err = run(ctx, code, opts)
+	} else {
+		code, opts = applyDirectives(code, opts)
+		code, cgo := cgoPreamble(code)
+		code = expandAliases(code, opts.Aliases)
+		topLevel, nonTopLevel, pkgsToImport, e := partition(code, opts.ModuleDir)
+		if e != nil {
+			err := asEvalError(e)
+			if err.Line > 0 {
+				err.File = opts.SourceName
+			}
+			return EvalResult{Errors: []EvalError{err}, ExitCode: NotRun}
+		}
+		if opts.SourceName != "" { // see parseErrors
+			topLevel = linePragmaPat.ReplaceAllString(topLevel, "//line "+opts.SourceName+":$1")
+			nonTopLevel = linePragmaPat.ReplaceAllString(nonTopLevel, "//line "+opts.SourceName+":$1")
+		}
+		topLevel = cgo + topLevel
+		topLevel, opts = addPrelude(opts.Prelude, topLevel, pkgsToImport, opts)
+		res, err = buildAndExec(ctx, topLevel, nonTopLevel, pkgsToImport, opts)
+	}
+	if err != "" {
+		res.Errors = parseErrors(err, opts.SourceName)
+	}
+	return res
 }
 
 type State struct {
 	// the current line number, while accumulating chunks
 	lineNum int
-	// inferred set of package names. The map's value is a dummy
-	pkgsToImport map[string]bool
+	// inferred set of import paths. The map's value is the name to import the package as,
+	// or "" to use the package's own name
+	pkgsToImport map[string]string
 	isTopLevel   bool
-	// lineNumber where the last bracket was opened
-	brackOpenAt int
-	// number of parens and curlies that have not been closed
-	brackCount int
-	// One of ')', '}',  or ' ' as a dummy value.
-	closingCh uint8
+	// the brackets that have not been closed, outermost first
+	brackets []openBracket
 	// for each line in input code, an array of chunks
-	chunks map[int][]Chunk
+	chunks map[int][]scanner.Chunk
+	// names declared so far with := or var, which aren't packages when they're used later
+	locals map[string]bool
+	// the directory of the module whose dependencies can be inferred (see Options.ModuleDir)
+	moduleDir string
 }
 
 // split code into topLevel and non-topLevel chunks. non-topLevel
@@ -148,27 +456,34 @@ type State struct {
 // input are traceable after reordering.
 // pkgsToImport contains standard package names inferred from code
 //
-func partition(code string) (topLevel string, nonTopLevel string, pkgsToImport map[string]bool) {
+// Errors from the scanner, such as a newline in a string literal, and unclosed brackets are
+// returned as an EvalError with the line number where they occurred.
+// Windows line endings are treated as plain newlines; Go itself drops carriage returns from raw
+// strings, and they can't appear unescaped in any other literal.
+func partition(code string, moduleDir string) (topLevel string, nonTopLevel string, pkgsToImport map[string]string, err error) {
 	state := &State{
 		lineNum:      1,
-		pkgsToImport: make(map[string]bool),
+		pkgsToImport: make(map[string]string),
 		isTopLevel:   false,
-		brackOpenAt:  0,
-		closingCh:    ' ',
-		brackCount:   0,
-		chunks:       make(map[int][]Chunk),
+		chunks:       make(map[int][]scanner.Chunk),
+		locals:       make(map[string]bool),
+		moduleDir:    moduleDir,
 	}
 
 	topLevel = ""
 	nonTopLevel = ""
-	scanner := NewScanner(code)
+	sc := scanner.NewScanner(strings.ReplaceAll(code, "\r\n", "\n"))
 	for {
-		chunk, err := nextChunk(scanner)
-		if err != nil {
-			if err == io.EOF {
+		chunk, e := scanner.NextChunk(sc)
+		if e != nil {
+			if e == io.EOF {
 				break
 			} else {
-				panic(err)
+				err := EvalError{Line: state.lineNum, Msg: e.Error()}
+				if e == scanner.ErrUnterminatedRaw {
+					err.Kind = IncompleteError
+				}
+				return "", "", nil, err
 			}
 		}
 		addChunk(state, chunk)
@@ -183,10 +498,208 @@ func partition(code string) (topLevel string, nonTopLevel string, pkgsToImport m
 		}
 	}
 
-	if state.brackCount > 0 {
-		panic(fmt.Sprintf("%d: Bracket or paren not closed. %d", state.brackOpenAt, state.brackCount))
+	if len(state.brackets) > 0 {
+		msg := fmt.Sprintf(unclosedMsg+" %d", len(state.brackets))
+		return "", "", nil, EvalError{Line: state.brackets[0].line, Msg: msg, Kind: IncompleteError}
+	}
+	// Don't infer what the user imports explicitly; the duplicate would cost a second compile.
+	// Blank and dot imports don't bring the package's name into scope, so a reference such as
+	// "pprof.Handler" still needs its own import.
+	for _, imp := range userImports(topLevel) {
+		if imp.name == "_" || imp.name == "." {
+			continue
+		}
+		delete(state.pkgsToImport, imp.path)
+		for path, alias := range state.pkgsToImport {
+			if alias == "" && pkgName(path) == imp.name {
+				delete(state.pkgsToImport, path)
+			}
+		}
+	}
+	return topLevel, nonTopLevel, state.pkgsToImport, nil
+}
+
+// Partition splits code the way Eval does before compiling it: topLevel holds the import, type
+// and func declarations, and nonTopLevel everything that goes in the body of main. Both contain
+// "//line" pragmas referring back to the lines of code. imports are the paths of the packages
+// code appears to use, sorted. Aliases are not expanded. If code can't be split, say because a
+// bracket isn't closed, err is an EvalError.
+func Partition(code string) (topLevel, nonTopLevel string, imports []string, err error) {
+	topLevel, nonTopLevel, pkgsToImport, err := partition(code, "")
+	if err != nil {
+		return "", "", nil, err
+	}
+	return topLevel, nonTopLevel, sortedPaths(pkgsToImport), nil
+}
+
+// InferImports returns the paths of the packages Eval would import for code, sorted, without
+// building anything. This is its first guess: once the compiler has had its say, Eval may drop
+// some of them, or swap one for another package of the same name. Packages code imports itself
+// aren't included. If code can't be split into declarations and statements, the result is nil.
+func InferImports(code string) []string {
+	code, _ = importDirectives(stripShebang(code))
+	_, _, pkgsToImport, err := partition(expandAliases(code, DefaultAliases), "")
+	if err != nil {
+		return nil
+	}
+	return sortedPaths(pkgsToImport)
+}
+
+const unclosedMsg = "Bracket or paren not closed."
+
+// IsComplete reports whether code could be evaluated as it is: its brackets are all closed, and
+// it doesn't end in the middle of a raw string or a comment. A REPL can keep reading lines until
+// the code it has read is complete. Other errors are left for evaluation to report.
+func IsComplete(code string) bool {
+	sc := scanner.NewScanner(code)
+	var last scanner.Chunk
+	for {
+		chunk, err := scanner.NextChunk(sc)
+		if err != nil {
+			break
+		}
+		last = chunk
+	}
+	if last.Kind == scanner.KCOMMENT && strings.HasPrefix(last.Text, "/*") &&
+		(len(last.Text) < 4 || !strings.HasSuffix(last.Text, "*/")) {
+		return false
+	}
+	_, _, _, err := partition(code, "")
+	return !errors.Is(err, ErrIncomplete)
+}
+
+// An import declared in the user's code
+type userImport struct {
+	name, path  string // name is the one it's imported as, perhaps "_" or "."
+	first, last int    // the lines of the declaration it's part of
+}
+
+// Parse the imports in topLevel, as returned by partition. The line numbers are the user's. If
+// the imports don't parse, the compiler will say why; we return none.
+func userImports(topLevel string) (imports []userImport) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", "package main\n"+topLevel, parser.ImportsOnly)
+	if err != nil {
+		return nil
+	}
+	for _, decl := range f.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.IMPORT {
+			continue
+		}
+		first, last := fset.Position(gen.Pos()).Line, fset.Position(gen.End()).Line
+		for _, spec := range gen.Specs {
+			spec := spec.(*ast.ImportSpec)
+			path, err := strconv.Unquote(spec.Path.Value)
+			if err != nil {
+				return nil
+			}
+			imp := userImport{name: pkgName(path), path: path, first: first, last: last}
+			if spec.Name != nil {
+				imp.name = spec.Name.Name
+			}
+			imports = append(imports, imp)
+		}
+	}
+	return imports
+}
+
+var cgoImportPat = regexp.MustCompile(`^\s*import\s+"C"\s*(?://.*)?$`)
+
+// Take cgo's import "C", and the comment just before it that is its preamble, out of code,
+// blanking out their lines so the line numbers of the rest don't change. cgo insists that the
+// comment come right before the import, so the pair is kept together, ahead of the rest of the
+// top-level code, where neither inferred imports nor line pragmas can come between them.
+func cgoPreamble(code string) (stripped string, cgo string) {
+	lines := strings.Split(code, "\n")
+	for i, line := range lines {
+		if !cgoImportPat.MatchString(line) {
+			continue
+		}
+		first := i
+		if first > 0 && strings.HasSuffix(strings.TrimSpace(lines[first-1]), "*/") {
+			for first--; first > 0 && !strings.Contains(lines[first], "/*"); first-- {
+			}
+		} else {
+			for first > 0 && strings.HasPrefix(strings.TrimSpace(lines[first-1]), "//") {
+				first--
+			}
+		}
+		cgo = strings.Join(lines[first:i+1], "\n") + "\n"
+		for j := first; j <= i; j++ {
+			lines[j] = ""
+		}
+		return strings.Join(lines, "\n"), cgo
+	}
+	return code, ""
+}
+
+// An import directive, "//gore:import path" or "//gore:import name path"
+var importDirectivePat = regexp.MustCompile(`^//gore:import\s+(?:(\w+)\s+)?(\S+)\s*$`)
+
+// Find the import directives in code's comments, and blank them out, leaving their newlines so
+// the line numbers of the rest don't change. imports are keyed by the name to import each
+// package as, which defaults to the package's own name.
+func importDirectives(code string) (stripped string, imports map[string]string) {
+	sc := scanner.NewScanner(code)
+	var b strings.Builder
+	for {
+		chunk, err := scanner.NextChunk(sc)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return code, nil // for partition to report
+		}
+		if chunk.Kind == scanner.KCOMMENT {
+			if m := importDirectivePat.FindStringSubmatch(strings.TrimSuffix(chunk.Text, "\n")); m != nil {
+				if imports == nil {
+					imports = make(map[string]string)
+				}
+				name := m[1]
+				if name == "" {
+					name = pkgName(m[2])
+				}
+				imports[name] = m[2]
+				chunk.Text = chunk.Text[len(strings.TrimSuffix(chunk.Text, "\n")):]
+			}
+		}
+		b.WriteString(chunk.Text)
 	}
-	return topLevel, nonTopLevel, state.pkgsToImport
+	return b.String(), imports
+}
+
+// Add imports to opts.Imports, without changing the caller's map
+func withImports(opts Options, imports map[string]string) Options {
+	if len(imports) == 0 {
+		return opts
+	}
+	all := make(map[string]string)
+	for _, m := range []map[string]string{imports, opts.Imports} {
+		for name, path := range m {
+			all[name] = path
+		}
+	}
+	opts.Imports = all
+	return opts
+}
+
+// Blank out the import directives in a snippet, adding the packages they name to opts.Imports.
+// Every way of evaluating a snippet starts with this, so that they all honor the directives.
+func applyDirectives(code string, opts Options) (string, Options) {
+	code, imports := importDirectives(code)
+	return code, withImports(opts, imports)
+}
+
+// Import fmt, which is available even to snippets that don't infer imports, unless the user
+// already has. Only a snippet that refers to fmt gets it, or it would be an unused import, and
+// cost another build to repair.
+func addFmt(topLevel string, pkgsToImport map[string]string) {
+	for _, imp := range userImports(topLevel) {
+		if imp.path == "fmt" && imp.name == "fmt" {
+			return
+		}
+	}
+	pkgsToImport["fmt"] = ""
 }
 
 func addLine(lineNum int, code string, line string) string {
@@ -200,25 +713,49 @@ func addLine(lineNum int, code string, line string) string {
 }
 
 // add a chunk to the current line in state.chunks
-func addChunk(state *State, chunk Chunk) {
+func addChunk(state *State, chunk scanner.Chunk) {
 	chunks, ok := state.chunks[state.lineNum]
 	if !ok {
-		chunks = []Chunk{}
+		chunks = []scanner.Chunk{}
 	}
 	state.chunks[state.lineNum] = append(chunks, chunk)
-	state.lineNum += chunk.numNL
+	state.lineNum += chunk.NumNL
 }
 
-/*func dumpChunks(chunks map[int][]Chunk, maxLine int) {
+/*func dumpChunks(chunks map[int][]scanner.Chunk, maxLine int) {
 	for i := 0; i <= maxLine; i++ {
 		if chunks, ok := chunks[i]; ok {
 			for _, chunk := range chunks {
-				print(chunk.text)
+				print(chunk.Text)
 			}
 		}
 	}
 }
 */
+// A bracket that has been opened, and the line it was opened on
+type openBracket struct {
+	ch   rune
+	line int
+}
+
+var closers = map[rune]rune{'(': ')', '[': ']', '{': '}'}
+
+// Close the innermost bracket that ch closes, and any opened since then, which can't be closed
+// any more; the compiler will say what's wrong with them. A closer that matches nothing open
+// closes the innermost bracket all the same, and an extra one is ignored, so that the snippet
+// is complete and the compiler gets to complain either way.
+func closeBracket(brackets []openBracket, ch rune) []openBracket {
+	for i := len(brackets) - 1; i >= 0; i-- {
+		if closers[brackets[i].ch] == ch {
+			return brackets[:i]
+		}
+	}
+	if len(brackets) > 0 {
+		return brackets[:len(brackets)-1]
+	}
+	return brackets
+}
+
 // Given a line number, extract all the chunks for that line, and
 // infer package names, and update numbers of opening and closing parens.
 //
@@ -231,352 +768,1241 @@ func processLine(lineNum int, state *State) (retLine string) {
 		return ""
 	}
 	for _, chunk := range chunks {
-		if chunk.kind == KTEXT {
-			inferPackages(chunk.text, state.pkgsToImport)
+		if chunk.Kind == scanner.KTEXT {
+			inferPackages(chunk.Text, state.pkgsToImport, state.locals, state.moduleDir)
 		}
 	}
 
 	// Since import and func declarations are not always on a single line, we need to
 	// accumulate whole blocks, which means we have to look for the closing paren (for imports)
-	// and curly (for func and type declarations). In order to account for
-	// nested parens/curlies, we use a simple (simplistic?) strategy that goes well with
-	// go code: only count open parens/brackets at end of line, and closing parens/curlies
-	// at beginning of line.
+	// and curly (for func and type declarations). A line at the top level of the snippet, outside
+	// any brackets, decides whether what follows up to the end of its brackets is a declaration.
+	// Brackets are matched over the whole line, so "if x { doit() }" opens and closes one.
+	// Square ones count too, for type parameter lists split over several lines.
 
 	// To eliminate the presence of curlies and parens inside comments and strings,
 	// extract text only from TEXT chunks.
 
 	l := strings.TrimLeft(extractTxt(chunks), " \t")
-	if len(l) > 0 {
-		// Is there a '}' or ')' at beginning of line, modulo comments
-		if l[0] == state.closingCh { //
-			state.brackCount--
-			if state.brackCount == 0 {
-				state.closingCh = ' ' // reset; note l[0] can never be ' ' because of TrimSpace
-				state.brackOpenAt = 0
-			}
-		} else if state.brackCount == 0 {
-			// look for func/type/import decls. This is the reason we could not trim trailing spaces
-			// earlier
-			state.isTopLevel = strings.HasPrefix(l, "func ") ||
-				strings.HasPrefix(l, "type ") ||
-				strings.HasPrefix(l, "import ")
-		}
-	}
-	l = strings.TrimSpace(l) // trailing whitespace
-	if len(l) > 0 {
-		// Is there a '{' or '(' at end of line modulo comments
-		switch l[len(l)-1] {
-		case '{':
-			state.closingCh = '}'
-			if state.brackCount == 0 {
-				state.brackOpenAt = state.lineNum
-			}
-			state.brackCount++
-		case '(':
-			state.closingCh = ')'
-			if state.brackCount == 0 {
-				state.brackOpenAt = state.lineNum
-			}
-			state.brackCount++
+	if len(l) > 0 && len(state.brackets) == 0 {
+		// look for func/type/import decls
+		state.isTopLevel = strings.HasPrefix(l, "func ") ||
+			strings.HasPrefix(l, "type ") ||
+			strings.HasPrefix(l, "import ")
+	}
+	for _, ch := range l {
+		switch ch {
+		case '{', '(', '[':
+			state.brackets = append(state.brackets, openBracket{ch, lineNum})
+		case '}', ')', ']':
+			state.brackets = closeBracket(state.brackets, ch)
 		}
 	}
 
 	// Concat chunks' texts
 	retLine = ""
 	for _, chunk := range chunks {
-		retLine += chunk.text
+		retLine += chunk.Text
 	}
 	return retLine
 }
 
-// Concatenate chunk.text from TEXT chunks into a single string
-func extractTxt(chunks []Chunk) (line string) {
+// Concatenate chunk.Text from TEXT chunks into a single string
+func extractTxt(chunks []scanner.Chunk) (line string) {
 	line = ""
 	for _, chunk := range chunks {
-		if chunk.kind == KTEXT {
-			line += chunk.text
+		if chunk.Kind == scanner.KTEXT {
+			line += chunk.Text
 		}
 	}
 	return line
 }
 
 // "p a,b,c" pretty prints each argument; it effectively expands to fmt.Printf("%+v %+v %+v\n", a, b, c)
+// "pp a,b,c" prints each argument in Go syntax; by default it expands to fmt.Printf("%#v\n", ...) for each
+// "d a,b,c" dumps each argument as indented JSON, falling back to "%+v" if it can't be marshaled
 // "t a,b,c" prints the type of each argument; it effectively expands to fmt.Printf("%T %T %T\n", a, b, c)
-// These aliases are expanded only if they are at the beginning of a line, and don't look like
-// a method call or variable assignment (e.g. "p := 10", or "p (100)"
-func expandAliases(code string) string {
+// "tv a,b,c" prints the type and value of each argument, as in "int = 3", one to a line
+// "e f()" prints the error f returns, if it isn't nil, and ends the program with exit status 1
+// "time f()" runs the statement f() and prints how long it took; "time x := f()" declares x as usual
+// The names "p", "pp", "d", "t", "tv", "e" and "time" are configurable (see Aliases); an empty name is never expanded.
+// These aliases are expanded only if they begin a statement, at the start of a line or after a
+// ";" (see replaceAlias), and don't look like a method call or variable assignment (e.g.
+// "p := 10", or "p (100)".
+// Expansion is purely textual: "p x" expands to __p(x) even if p has been declared as a variable,
+// since "p x" could not be valid Go anyway.
+// Aliases registered with RegisterAlias are expanded first, in order of name.
+func expandAliases(code string, aliases Aliases) string {
+	aliasLock.Lock()
+	custom := make(map[string]func(args string) string, len(customAliases))
+	names := make([]string, 0, len(customAliases))
+	for name, expand := range customAliases {
+		custom[name] = expand
+		names = append(names, name)
+	}
+	aliasLock.Unlock()
+	sort.Strings(names)
+	for _, name := range names {
+		code = replaceAlias(code, name, custom[name])
+	}
+	// A registered alias overrides the built-in one of the same name
+	builtin := func(name string) string {
+		if _, ok := custom[name]; ok {
+			return ""
+		}
+		return name
+	}
+
 	// Expand "p foo(), 2*3"   to __p(foo(), 2*3). __p is defined in the template in buildMain
-	// Look for p followed by spaces followed by something that doesn't start with =, : or (
-	r := regexp.MustCompile(`(?m)^\s*p +([^\s=:(].*)$`)
-	code = r.ReplaceAllString(code, "__p($1)")
+	code = expandAlias(code, builtin(aliases.Print), "__p")
+
+	// Expand "pp foo(), 2*3"  to __pp(foo(), 2*3), which prints with Options.PrettyVerb
+	code = expandAlias(code, builtin(aliases.PrettyPrint), "__pp")
+
+	// Expand "d foo(), 2*3"   to __d(foo(), 2*3); buildMain defines __d only if it's used
+	code = expandAlias(code, builtin(aliases.Dump), "__d")
 
 	// Expand "t foo(), 2*3"   to __t(foo(), 2*3), where __t prints the type of each arg
-	r = regexp.MustCompile(`(?m)^\s*t +([^\s=:(].*)$`)
-	return r.ReplaceAllString(code, "__t($1)")
+	code = expandAlias(code, builtin(aliases.Type), "__t")
+
+	// Expand "tv foo(), 2*3"  to __tv(foo(), 2*3), where __tv prints the type and value of each
+	code = expandAlias(code, builtin(aliases.TypeValue), "__tv")
+
+	// Expand "e foo()"        to __e(foo()); buildMain defines __e only if it's used
+	code = expandAlias(code, builtin(aliases.Check), "__e")
+
+	// Expand "time foo()"     to __timed(func() { foo() }), which times the statement. The
+	// time package itself is always followed by a dot, so it's never taken for the alias. An
+	// assignment, as in "time x := foo()", is left out of the closure, so that the variables it
+	// declares can be used afterwards; the func that __timer returns times it instead.
+	timers := 0
+	return replaceAlias(code, builtin(aliases.Time), func(args string) string {
+		if !definePat.MatchString(args) {
+			return "__timed(func() { " + args + " })"
+		}
+		timers++
+		stop := fmt.Sprintf("__stop%d", timers) // one per timer, since they share main's scope
+		return stop + " := __timer(); " + args + "; " + stop + "()"
+	})
 }
 
-var pkgPat = regexp.MustCompile(`(?m)\b[a-z]\w+\.`)
+// A statement that declares or assigns to variables, as in "x, err := f()". Coming after an
+// alias's name, it doesn't use the name as a variable (see isOperand).
+var definePat = regexp.MustCompile(`^[\pL_][\pL\pN_]*(?:\s*,\s*[\pL_][\pL\pN_]*)*\s*:?=(?:[^=]|$)`)
+
+func expandAlias(code string, name string, helper string) string {
+	return replaceAlias(code, name, func(args string) string { return helper + "(" + args + ")" })
+}
+
+// Look for the name followed by spaces followed by something that doesn't start with =, : or (,
+// at the start of a statement. The indentation mustn't match newlines, or blank lines before
+// the alias would vanish along with it, throwing off the line numbers of everything that follows.
+func aliasPattern(name string) *regexp.Regexp {
+	return regexp.MustCompile(`^([ \t]*)` + regexp.QuoteMeta(name) + ` +[^\s=:(]`)
+}
+
+// The part of a line before an alias that's in the header of a for, if or switch statement, as
+// in "for p := l; p != nil; p = p.next {", or in a struct or interface type, as in
+// "struct{ x int; t string }", where it's no alias at all
+var headerPat = regexp.MustCompile(`(?:^|[;{}])\s*(?:for|(?:else\s+)?if|switch)\b[^{}]*$|\b(?:struct|interface)\s*\{[^}]*$`)
+
+// The part of a line before a "{" that opens a block, as in "if x > 1 {" or "go func() {", rather
+// than a composite literal or a struct type
+var blockPat = regexp.MustCompile(`(?:(?:^|[;{}])\s*(?:(?:for|(?:else\s+)?if|switch|select)\b[^{}]*|else\s*)?|\bfunc\b[^{}]*)$`)
+
+// Replace each use of the alias name in code with expand(args). An alias begins a line, or
+// follows the ";" that ends an earlier statement, as in "x := 1; p x", or the "{" that begins a
+// block, as in "if ok { p x }", but not one in a string
+// or a comment, or in a for, if or switch header, nor where the statement assigns to or changes
+// a variable of the same name (see isOperand). The arguments end where the statement does, so
+// neither a comment after it, nor a trailing \r from a Windows line ending, is passed to expand.
+// A raw string that goes on over several lines is taken as part of the line it begins on, so
+// that it can be an argument, and its own lines are never taken for aliases.
+func replaceAlias(code string, name string, expand func(args string) string) string {
+	if name == "" {
+		return code
+	}
+	r := aliasPattern(name)
+	lines := joinRawStrings(strings.Split(code, "\n"))
+	for i, line := range lines {
+		done, start := "", true // the part of the line already looked at; whether a statement begins next
+		for {
+			if m := r.FindStringSubmatchIndex(line); m != nil && start && !headerPat.MatchString(done) {
+				argStart := m[1] - 1
+				args := strings.TrimRight(line[argStart:argStart+statementEnd(line[argStart:], false)], " \t\r")
+				if !isOperand(args) {
+					done += line[:m[3]] + expand(args)
+					line = line[argStart+len(args):]
+				}
+			}
+			// On to the next statement, past any closing brackets, or into a block
+			end := statementEnd(line, true)
+			if end == len(line) || line[end] == '/' {
+				break
+			}
+			start = line[end] == ';' || line[end] == '{' && blockPat.MatchString(done+line[:end])
+			done, line = done+line[:end+1], line[end+1:]
+		}
+		lines[i] = done + line
+	}
+	return strings.Join(lines, "\n")
+}
+
+// An operator after a name that makes the name an operand, and so not an alias: an assignment
+// operator, as in "d += 2", an increment or decrement, a send, as in "e <- 1" (but "p <-c"
+// receives), or a selector, as in "d .x" (but "p .5" is a number)
+var operatorPat = regexp.MustCompile(`^(?:(?:[-+*/%&|^]|<<|>>|&\^)=|\+\+|--|<-\s|\.[^0-9])`)
+
+// Whether the statement that follows an alias's name, args, uses the name as a variable
+// instead: it begins with operatorPat, ends in ++ or --, or assigns to something, as in
+// "d [0] = 1". An assignment to plain variables, as in "time x := f()", is the alias's argument.
+func isOperand(args string) bool {
+	if operatorPat.MatchString(args) || strings.HasSuffix(args, "++") || strings.HasSuffix(args, "--") {
+		return true
+	}
+	if definePat.MatchString(args) {
+		return false
+	}
+	depth := 0
+	var quote rune // the quote of the literal we're in, if any
+	escaped := false
+	for i, ch := range args {
+		switch {
+		case quote != 0:
+			if escaped {
+				escaped = false
+			} else if ch == '\\' && quote != '`' {
+				escaped = true
+			} else if ch == quote {
+				quote = 0
+			}
+		case ch == '"' || ch == '`' || ch == '\'':
+			quote = ch
+		case ch == '(' || ch == '[' || ch == '{':
+			depth++
+		case ch == ')' || ch == ']' || ch == '}':
+			depth--
+		case ch == '=' && depth == 0 && i > 0 && !strings.HasPrefix(args[i+1:], "="):
+			// not ==, !=, <= or >=, though <<= and >>= are assignments
+			switch prev := args[i-1]; prev {
+			case '=', '!':
+			case '<', '>':
+				if i > 1 && args[i-2] == prev {
+					return true
+				}
+			default:
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Join each line that ends in the middle of a raw string with those that follow, up to the one
+// where it ends
+func joinRawStrings(lines []string) (joined []string) {
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		for inRawString(line) && i+1 < len(lines) {
+			i++
+			line += "\n" + lines[i]
+		}
+		joined = append(joined, line)
+	}
+	return joined
+}
+
+// Whether text ends inside a raw string. Other strings and runes are skipped, as is a comment at
+// the end.
+func inRawString(text string) bool {
+	var quote rune
+	escaped := false
+	for i, ch := range text {
+		switch {
+		case quote != 0:
+			if escaped {
+				escaped = false
+			} else if ch == '\\' && quote != '`' {
+				escaped = true
+			} else if ch == quote {
+				quote = 0
+			}
+		case ch == '"' || ch == '`' || ch == '\'':
+			quote = ch
+		case ch == '/' && strings.HasPrefix(text[i+1:], "/"):
+			return false
+		}
+	}
+	return quote == '`'
+}
+
+// Where the statement that line begins with ends: at a ";", a closing bracket that it didn't
+// open or a comment, if not at the end of the line. A ";" inside brackets, as in a func literal,
+// only counts if nested is set, as does any "{", where a block may begin. Strings and runes are
+// skipped.
+func statementEnd(line string, nested bool) int {
+	depth := 0
+	var quote rune // the quote of the literal we're in, if any
+	escaped := false
+	for i, ch := range line {
+		switch {
+		case quote != 0:
+			if escaped {
+				escaped = false
+			} else if ch == '\\' && quote != '`' {
+				escaped = true
+			} else if ch == quote {
+				quote = 0
+			}
+		case ch == '"' || ch == '`' || ch == '\'':
+			quote = ch
+		case ch == '/' && (strings.HasPrefix(line[i+1:], "/") || strings.HasPrefix(line[i+1:], "*")):
+			return i
+		case ch == '{' && nested:
+			return i
+		case ch == '(' || ch == '[' || ch == '{':
+			depth++
+		case ch == ')' || ch == ']' || ch == '}':
+			if depth--; depth < 0 {
+				return i
+			}
+		case ch == ';' && (depth == 0 || nested):
+			return i
+		}
+	}
+	return len(line)
+}
+
+var (
+	aliasLock     sync.Mutex
+	customAliases = make(map[string]func(args string) string)
+)
+
+// RegisterAlias defines an alias for all evaluations from now on. Like the built-in ones, it's
+// expanded where it begins a statement, when followed by spaces and something that doesn't look
+// like an assignment or a call: the rest of the statement is passed to expand as args, and the
+// statement is replaced by the result, indented as before. The result should be a single line, or the line
+// numbers of errors will be off. For example,
+//
+//	eval.RegisterAlias("j", func(args string) string { return "__d(" + args + ")" })
+//
+// makes "j x" dump x as JSON, just as "d x" does. A registered alias overrides the built-in one
+// of the same name, if any; a nil expand removes the registration. To disable a built-in alias,
+// clear its name in Options.Aliases.
+func RegisterAlias(name string, expand func(args string) string) {
+	aliasLock.Lock()
+	defer aliasLock.Unlock()
+	if expand == nil {
+		delete(customAliases, name)
+	} else {
+		customAliases[name] = expand
+	}
+}
+
+// An identifier followed by a dot, unless it's itself preceded by one, as "bytes" in
+// "x.bytes.Len()" is a field
+var pkgPat = regexp.MustCompile(`(?:^|[^.\w])([A-Za-z_]\w*)\.`)
+
+// Declarations of one or more names, as in "a, b := f()" and "var log = ..."
+var localPat = regexp.MustCompile(`(?:^|[^.\w])((?:[A-Za-z_]\w*\s*,\s*)*[A-Za-z_]\w*)\s*:=|\bvar\s+((?:\w+\s*,\s*)*\w+)`)
 
 // Look for strings of the form "xyz.Abc" or "xyz.abc"; we assume "xyz" is an
 // imported package, and if the compiler barfs, we'll remove that assumption
 // and recompile again. See buildAndExec
-func inferPackages(code string, pkgsToImport map[string]bool) {
-	pkgs := pkgPat.FindAllString(code, -1)
-	for _, pkg := range pkgs {
-		pkg = pkg[:len(pkg)-1] // remove trailing '.'
-		if importPkg, ok := builtinPkgs[pkg]; ok {
-			pkgsToImport[importPkg] = true
+// Besides the standard library, "xyz" may name a package the current module depends on.
+// Names in locals, and those code declares before using them, are taken to be variables. That
+// ignores scope, so if it's wrong, the compiler says the package is undefined and
+// buildAndExec imports it after all (see unshadow).
+func inferPackages(code string, pkgsToImport map[string]string, locals map[string]bool, moduleDir string) {
+	decls := localPat.FindAllStringSubmatchIndex(code, -1)
+	// Note the names declared before offset
+	declare := func(offset int) {
+		for len(decls) > 0 && decls[0][1] <= offset {
+			for _, group := range [][]int{decls[0][2:4], decls[0][4:6]} {
+				if group[0] >= 0 {
+					for _, name := range strings.Split(code[group[0]:group[1]], ",") {
+						locals[strings.TrimSpace(name)] = true
+					}
+				}
+			}
+			decls = decls[1:]
+		}
+	}
+	defer declare(len(code))
+	for _, m := range pkgPat.FindAllStringSubmatchIndex(code, -1) {
+		declare(m[0])
+		pkg := code[m[2]:m[3]]
+		if locals[pkg] {
+			continue
+		}
+		if importPkg, ok := builtinPackages()[pkg]; ok {
+			pkgsToImport[importPkg] = ""
+		} else if importPkg, ok := modulePackages(moduleDir)[pkg]; ok {
+			pkgsToImport[importPkg] = ""
 		}
 	}
 }
 
-func buildAndExec(topLevel string, nonTopLevel string, pkgsToImport map[string]bool) (out string, err string) {
-	pkgsToImport["fmt"] = true // Explicitly imported in the template below in buildMain
-	// If "fmt" is explicitly imported by the user, the compiler will flag a duplicate import error, and
-	// repairImports takes care of the problem.
-	src := buildMain(topLevel, nonTopLevel, pkgsToImport)
-	out, err = run(src)
+// The most times buildAndExec compiles a snippet, repairing its imports in between. Each
+// repair can reveal another problem, as when removing one import exposes a clash with another.
+const maxAttempts = 4
+
+func buildAndExec(ctx context.Context, topLevel string, nonTopLevel string, pkgsToImport map[string]string, opts Options) (res EvalResult, err string) {
+	if !opts.InferImports {
+		_, usesFmt := pkgsToImport["fmt"]
+		for path := range pkgsToImport {
+			delete(pkgsToImport, path)
+		}
+		if usesFmt {
+			addFmt(topLevel, pkgsToImport)
+		}
+	}
+	addImports(pkgsToImport, opts.Imports)
+	if hasTests(topLevel) {
+		pkgsToImport["testing"] = "" // inferred anyway, unless "go list std" failed
+	}
+	imported := sortedPaths(pkgsToImport)
+	body, wrapped := nonTopLevel, map[int]bool(nil)
+	if opts.AutoPrint || opts.CaptureValue {
+		body, wrapped = autoPrint(nonTopLevel, nil, opts)
+	}
+	src := buildMain(topLevel, body, pkgsToImport, opts)
+	res, err = run(ctx, src, opts)
+	notes := "" // from go get, say
+	stubs := make(map[string]bool)
+	for attempt := 1; err != "" && attempt < maxAttempts; attempt++ {
+		retry := repairImports(err, pkgsToImport)
+		if switchVariant(err, pkgsToImport, opts.Imports) {
+			retry = true
+		}
+		if opts.InferImports && unshadow(err, pkgsToImport, opts.ModuleDir) {
+			retry = true
+		}
+		if opts.StubUndefined && stubUndefined(err, stubs, opts) {
+			retry = true
+		}
+		if lines := valuelessLines(err, wrapped, opts.SourceName); len(lines) > 0 {
+			skip := make(map[int]bool)
+			for _, line := range lines {
+				skip[line] = true
+			}
+			body, _ = autoPrint(nonTopLevel, skip, opts)
+			retry = true
+		}
+		fetched := false
+		if opts.FetchModules {
+			var msg string
+			fetched, msg = fetchPackages(ctx, err, pkgsToImport, opts)
+			notes += msg
+		}
+		if !retry && !fetched {
+			break
+		}
+		prev := src
+		_, decls := stubDecls(stubs)
+		src = buildMain(topLevel+decls, body, pkgsToImport, opts)
+		if src == prev && !fetched { // the repairs changed nothing, so the same errors would recur
+			break
+		}
+		res, err = run(ctx, src, opts)
+	}
+	res.Stubbed, _ = stubDecls(stubs)
 	if err != "" {
-		if repairImports(err, pkgsToImport) {
-			src = buildMain(topLevel, nonTopLevel, pkgsToImport)
-			out, err = run(src)
+		err += notes + ambiguityNotes(err, opts.ModuleDir)
+		if opts.Verbose {
+			err += importReport(imported, pkgsToImport)
+		}
+	}
+	return res, err
+}
+
+// Summarize which packages were imported automatically, and which of those repairImports removed
+func importReport(imported []string, pkgsToImport map[string]string) string {
+	var removed []string
+	for _, path := range imported {
+		if _, ok := pkgsToImport[path]; !ok {
+			removed = append(removed, path)
+		}
+	}
+	report := "auto-imported: " + strings.Join(imported, ", ")
+	if len(removed) > 0 {
+		report += "; removed after retry: " + strings.Join(removed, ", ")
+	}
+	return report + "\n"
+}
+
+func sortedPaths(pkgsToImport map[string]string) []string {
+	paths := make([]string, 0, len(pkgsToImport))
+	for path := range pkgsToImport {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Merge imports (name -> import path) into pkgsToImport. An empty name means the package's own
+// name. Inferred packages that would clash with one of these names are dropped, since the caller
+// presumably knows better.
+func addImports(pkgsToImport map[string]string, imports map[string]string) {
+	if len(imports) == 0 {
+		return
+	}
+	names := make(map[string]bool)
+	for name, path := range imports {
+		if name == "" {
+			name = pkgName(path)
 		}
+		names[name] = true
+	}
+	for path, alias := range pkgsToImport {
+		if alias == "" && names[pkgName(path)] {
+			delete(pkgsToImport, path)
+		}
+	}
+	for name, path := range imports {
+		if name == pkgName(path) {
+			name = ""
+		}
+		pkgsToImport[path] = name
 	}
-	return out, err
+}
+
+var (
+	versionPat  = regexp.MustCompile(`^v[0-9]+$`)
+	nonIdentPat = regexp.MustCompile(`[^A-Za-z0-9_]`)
+)
+
+// The default name of the package with the given import path: its last element, ignoring a
+// major version suffix as in "example.com/y/v2" or "gopkg.in/yaml.v3"
+func pkgName(path string) string {
+	elems := strings.Split(path, "/")
+	name := elems[len(elems)-1]
+	if len(elems) > 1 && versionPat.MatchString(name) {
+		name = elems[len(elems)-2]
+	}
+	if i := strings.Index(name, ".v"); i > 0 && versionPat.MatchString(name[i+1:]) {
+		name = name[:i]
+	}
+	return name
+}
+
+// Give an alias to packages that would otherwise be imported under the same name. The package
+// that keeps the name is one with an explicit alias, or else the first by import path; the others
+// are named after their parent directory as well, as in "cryptorand" for "crypto/rand".
+func disambiguate(pkgsToImport map[string]string) {
+	byName := make(map[string][]string)
+	for path, alias := range pkgsToImport {
+		name := alias
+		if name == "" {
+			name = pkgName(path)
+		}
+		byName[name] = append(byName[name], path)
+	}
+	for name, paths := range byName {
+		if len(paths) < 2 {
+			continue
+		}
+		sort.Slice(paths, func(i, j int) bool {
+			// explicitly aliased first, then by path
+			ei, ej := pkgsToImport[paths[i]] != "", pkgsToImport[paths[j]] != ""
+			if ei != ej {
+				return ei
+			}
+			return paths[i] < paths[j]
+		})
+		for _, path := range paths[1:] {
+			parent := "pkg"
+			if elems := strings.Split(path, "/"); len(elems) > 1 {
+				parent = nonIdentPat.ReplaceAllString(elems[len(elems)-2], "")
+			}
+			pkgsToImport[path] = parent + name
+		}
+	}
+}
+
+// Compile errors that mean one of our imports was an incorrect guess: either unused, or clashing
+// with a name the user declared. The compiler's wording has changed over the years, so several
+// phrasings are recognized. Each pattern captures the import path.
+var repairPathPats = []*regexp.Regexp{
+	regexp.MustCompile(`(?m)"([^"]+)" imported (?:as \w+ )?and not used`),
+	regexp.MustCompile(`(?m)\w+ already declared through import of package \w+ \("([^"]+)"\)`),
+	regexp.MustCompile(`(?m)imported and not used: "([^"]+)"`), // before go1.20
+}
+
+// Like repairPathPats, but each pattern captures the package name
+var repairNamePats = []*regexp.Regexp{
+	regexp.MustCompile(`(?m)(\w+) redeclared in this block`),
+	regexp.MustCompile(`(?m)(\w+) redeclared as imported package name`), // before go1.20
 }
 
 // Look for compile errors of the form
-//    "test.go:10: xxx redeclared as imported package name"
+//
+//	"test.go:10: "xxx" imported and not used"
+//	"test.go:10: xxx redeclared in this block"
+//
 // and remove 'xxx' from pkgsToImport
 // This is the most fragile part of this tool; it breaks if the compiler error message changes
-func repairImports(err string, pkgsToImport map[string]bool) (dupsDetected bool) {
+func repairImports(err string, pkgsToImport map[string]string) (dupsDetected bool) {
 	dupsDetected = false
-	var pkg string
-	r := regexp.MustCompile(`(?m)(\w+) redeclared as imported package name|imported and not used: "(\w+)"`)
-	for _, match := range r.FindAllStringSubmatch(err, -1) {
-		// Either $1 or $2 will have name of pkg name that's been imported
-		if match[1] != "" {
-			pkg = match[1]
-		} else if match[2] != "" {
-			pkg = match[2]
-		}
-		if pkgsToImport[pkg] {
+	remove := func(path string) {
+		// Blank and dot imports are the user's, never guesses; the compiler's complaints about
+		// a dot import are the user's to fix
+		if alias, ok := pkgsToImport[path]; ok && alias != "_" && alias != "." {
 			// Was the duplicate import our mistake, due to an incorrect guess? If so ...
-			delete(pkgsToImport, pkg)
+			delete(pkgsToImport, path)
 			dupsDetected = true
 		}
 	}
+	for _, r := range repairPathPats {
+		for _, match := range r.FindAllStringSubmatch(err, -1) {
+			remove(match[1])
+		}
+	}
+	for _, r := range repairNamePats {
+		for _, match := range r.FindAllStringSubmatch(err, -1) {
+			for path, alias := range pkgsToImport {
+				if alias == match[1] || alias == "" && pkgName(path) == match[1] {
+					remove(path)
+				}
+			}
+		}
+	}
 	return dupsDetected
 }
 
-// save in a temp file, and "go run" it
-func run(src string) (output string, err string) {
-	tmpfile := save(src)
-	cmd := exec.Command("go", "run", tmpfile)
-	out, e := cmd.CombinedOutput()
-	if e != nil {
-		err = ""
-		errPat := regexp.MustCompile(`^:(\d+)\[.*\]:(.*)$`)
-		for _, e := range strings.Split(string(out), "\n") {
-			if strings.HasPrefix(e, "# command-line-arguments") {
+// inferPackages doesn't import a package whose name the snippet also declares as a variable. If
+// the compiler then says the name is undefined, the variable was out of scope, so import the
+// package after all.
+func unshadow(err string, pkgsToImport map[string]string, moduleDir string) (added bool) {
+	for _, match := range undefinedPat.FindAllStringSubmatch(err, -1) {
+		path, ok := builtinPackages()[match[1]]
+		if !ok {
+			path, ok = modulePackages(moduleDir)[match[1]]
+		}
+		if _, imported := pkgsToImport[path]; ok && !imported {
+			pkgsToImport[path] = ""
+			added = true
+		}
+	}
+	return added
+}
+
+var undefinedNamePat = regexp.MustCompile(`(?m)undefined: (\w+)$`)
+
+// With Options.StubUndefined, declare each name the compiler says is undefined as a variable of
+// type interface{}, unless it's a package that unshadow imports instead. stubs holds the
+// names declared so far.
+func stubUndefined(err string, stubs map[string]bool, opts Options) (added bool) {
+	for _, match := range undefinedNamePat.FindAllStringSubmatch(err, -1) {
+		name := match[1]
+		if _, ok := builtinPackages()[name]; ok {
+			continue
+		} else if _, ok := modulePackages(opts.ModuleDir)[name]; ok {
+			continue
+		} else if _, ok := wellKnownPackages[name]; ok && opts.FetchModules {
+			continue
+		}
+		if !stubs[name] {
+			stubs[name] = true
+			added = true
+		}
+	}
+	return added
+}
+
+// The names of the stubs, sorted, and their declarations, each on a line of its own
+func stubDecls(stubs map[string]bool) (names []string, decls string) {
+	for name := range stubs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		decls += "\nvar " + name + " interface{}"
+	}
+	return names, decls
+}
+
+var undefinedSelPat = regexp.MustCompile(`(?m)undefined: (\w+)\.\w+`)
+
+// Several standard packages share some names; "rand" could be math/rand, crypto/rand or
+// math/rand/v2. If the compiler says the package we guessed doesn't have what the snippet uses,
+// as in "undefined: rand.Text", import the next package of that name instead (see stdVariants).
+// Packages the caller asked for by name in forced are left alone.
+func switchVariant(err string, pkgsToImport map[string]string, forced map[string]string) (switched bool) {
+	seen := make(map[string]bool)
+	for _, match := range undefinedSelPat.FindAllStringSubmatch(err, -1) {
+		name := match[1]
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		variants := stdVariants[name]
+		for i := 0; i+1 < len(variants); i++ {
+			path := variants[i]
+			if alias, ok := pkgsToImport[path]; !ok || alias != "" || isForced(path, forced) {
 				continue
 			}
-			err += errPat.ReplaceAllString(e, ":$1:$2\n")
+			delete(pkgsToImport, path)
+			pkgsToImport[variants[i+1]] = ""
+			switched = true
+			break
 		}
-		return "", err
+	}
+	return switched
+}
+
+func isForced(path string, forced map[string]string) bool {
+	for _, p := range forced {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+// Compile src (see build) and run the resulting program. If it can't be run, err holds the raw
+// compiler output (see parseErrors), and the exit code is NotRun. Both steps are killed if ctx is
+// done. With Options.CompileOnly, src is only compiled, and the exit code is NotRun regardless.
+func run(ctx context.Context, src string, opts Options) (res EvalResult, err string) {
+	res.ExitCode = NotRun
+	if opts.Transform != nil {
+		src = opts.Transform(src)
+	}
+	bin, cleanup := "", func() {}
+	if opts.CompileOnly {
+		err = compileOnly(ctx, src, opts)
 	} else {
-		return string(out), ""
+		bin, cleanup, err = build(ctx, src, opts)
+	}
+	defer cleanup()
+	if err == "" && !opts.CompileOnly && opts.KeepBinary != "" {
+		res.Binary = keepBinary(bin, opts.KeepBinary)
+	}
+	if err == "" && opts.Vet {
+		res.Warnings = vet(ctx, src, opts)
+	}
+	if err == "" && !opts.CompileOnly {
+		var e error
+		var args []string
+		if hasTests(src) {
+			args = append(args, "-test.v")
+		}
+		if benchFuncPat.MatchString(src) {
+			args = append(args, "-test.bench=.", "-test.benchmem")
+		}
+		cmd := command(ctx, bin, append(args, opts.Args...)...)
+		dir, removeDir := workDir(opts)
+		defer removeDir()
+		cmd.Dir = dir
+		cmd.Stdin = opts.Stdin
+		if opts.ForceColor {
+			// The output is piped, so programs that check for a terminal wouldn't use color
+			cmd.Env = append(os.Environ(), "CLICOLOR_FORCE=1", "FORCE_COLOR=1")
+		}
+		if opts.Env != nil {
+			if cmd.Env == nil {
+				cmd.Env = os.Environ()
+			}
+			// Appended last, so they override inherited ones, and in order, so every run is alike
+			names := make([]string, 0, len(opts.Env))
+			for name := range opts.Env {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				cmd.Env = append(cmd.Env, name+"="+opts.Env[name])
+			}
+		}
+		if opts.CaptureValue {
+			read := valueFile(cmd)
+			defer func() { res.Value = read() }()
+		}
+		if opts.Stdout != nil || opts.Stderr != nil {
+			cmd.Stdout, cmd.Stderr = opts.Stdout, opts.Stderr
+			e = cmd.Run()
+		} else if opts.SeparateOutput {
+			stdout, stderr := &limitWriter{max: opts.MaxOutput}, &limitWriter{max: opts.MaxOutput}
+			cmd.Stdout, cmd.Stderr = stdout, stderr
+			e = cmd.Run()
+			res.Stdout, res.Stderr = stdout.String(), stderr.String()
+			res.Out = res.Stdout + res.Stderr
+		} else {
+			out := &limitWriter{max: opts.MaxOutput}
+			cmd.Stdout, cmd.Stderr = out, out
+			e = cmd.Run()
+			res.Out = out.String()
+		}
+		if exit, ok := e.(*exec.ExitError); ok {
+			res.ExitCode = exit.ExitCode()
+		} else if e != nil {
+			err = e.Error()
+		} else {
+			res.ExitCode = 0
+		}
 	}
-	return "", ""
+	if ctx.Err() != nil {
+		return EvalResult{ExitCode: NotRun}, "evaluation cancelled: " + ctx.Err().Error()
+	}
+	return res, err
 }
 
-func save(src string) (tmpfile string) {
-	tmpdir := os.Getenv("TMPDIR")
-	if tmpdir == "" {
-		tmpdir = os.Getenv("TEMPDIR")
+// The directory to run the program in: Options.WorkDir, or else a new temp directory, which
+// remove deletes unless Options.KeepTemp is set
+func workDir(opts Options) (dir string, remove func()) {
+	if opts.WorkDir != "" {
+		return opts.WorkDir, func() {}
 	}
-	if tmpdir == "" {
-		tmpdir = os.TempDir()
+	dir, err := os.MkdirTemp("", "gore_run")
+	if err != nil {
+		systemFailure("Unable to create working directory", err)
+	}
+	if opts.Debug != nil {
+		fmt.Fprintf(opts.Debug, "// running in %s\n", dir)
+	}
+	if opts.KeepTemp {
+		return dir, func() {}
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// A limitWriter collects at most max bytes (if max > 0), and counts the rest
+type limitWriter struct {
+	max     int
+	buf     bytes.Buffer
+	dropped int
+}
+
+func (w *limitWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if w.max > 0 && w.buf.Len()+len(p) > w.max {
+		keep := w.max - w.buf.Len()
+		w.dropped += len(p) - keep
+		p = p[:keep]
 	}
-	tmpfile = path.Join(tmpdir, "gore_eval.go")
-	fh, err := os.OpenFile(tmpfile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	w.buf.Write(p)
+	return n, nil // pretend to write it all, so the program isn't killed by a closed pipe
+}
+
+// The collected output, followed by a note of how much was dropped, if any
+func (w *limitWriter) String() string {
+	if w.dropped == 0 {
+		return w.buf.String()
+	}
+	return w.buf.String() + fmt.Sprintf("... [truncated %d bytes]", w.dropped)
+}
+
+var (
+	testFuncPat  = regexp.MustCompile(`(?m)^func Test(?:[^a-z]\w*)?\(\w+ \*testing\.T\)`)
+	benchFuncPat = regexp.MustCompile(`(?m)^func Benchmark(?:[^a-z]\w*)?\(\w+ \*testing\.B\)`)
+)
+
+// Whether src declares test or benchmark functions, in which case it's built with "go test" and
+// running it runs those instead of main
+func hasTests(src string) bool {
+	return testFuncPat.MatchString(src) || benchFuncPat.MatchString(src)
+}
+
+// The environment variable naming the file __value saves its results in
+const valueFileEnv = "GORE_VALUE_FILE"
+
+// Give cmd a file to save the value of an expression in (see valueHelper). read returns that
+// value, or nil if the program didn't save one, and removes the file.
+func valueFile(cmd *exec.Cmd) (read func() *Value) {
+	fh, err := os.CreateTemp("", "gore_value_*.json")
 	if err != nil {
-		panic("Unable to open file: '" + tmpfile + "': " + err.Error())
+		return func() *Value { return nil }
 	}
-	fh.WriteString(src)
 	fh.Close()
-	return tmpfile
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, valueFileEnv+"="+fh.Name())
+	return func() *Value {
+		defer os.Remove(fh.Name())
+		var saved struct {
+			Type string
+			JSON json.RawMessage
+			Text string
+		}
+		buf, err := os.ReadFile(fh.Name())
+		if err != nil || len(buf) == 0 || json.Unmarshal(buf, &saved) != nil {
+			return nil
+		}
+		v := &Value{Type: saved.Type, Text: saved.Text}
+		if len(saved.JSON) > 0 {
+			v.JSON = saved.JSON
+		}
+		return v
+	}
+}
+
+// Like exec.CommandContext, but cancelling also kills any processes the command started
+func command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	setProcessGroup(cmd)
+	cmd.WaitDelay = time.Second
+	return cmd
 }
 
-func buildMain(topLevel string, nonTopLevel string, pkgsToImport map[string]bool) string {
+// Save src in a temp file of its own, so that concurrent evaluations don't clobber each other.
+// A file it must be: the go command won't read source from stdin ("go run -" just says no go
+// files are listed).
+// For debugging, if GORE_TMPDIR, TMPDIR or TEMPDIR is set explicitly (in that order of
+// preference), src is also copied to gore_eval.go there, creating the directory if need be;
+// concurrent evaluations may overwrite that copy, but it isn't the one compiled. With
+// Options.Debug, src is written there too.
+func save(src string, opts Options) (tmpfile string) {
+	tmpdir := ""
+	for _, env := range []string{"GORE_TMPDIR", "TMPDIR", "TEMPDIR"} {
+		if tmpdir = os.Getenv(env); tmpdir != "" {
+			break
+		}
+	}
+	if tmpdir != "" {
+		if err := os.MkdirAll(tmpdir, 0777); err != nil {
+			systemFailure("Unable to create directory", err)
+		}
+		debugfile := path.Join(tmpdir, "gore_eval.go")
+		if err := os.WriteFile(debugfile, []byte(src), 0666); err != nil {
+			systemFailure("Unable to open file: '"+debugfile+"'", err)
+		}
+	}
+
+	pattern := "gore_eval_*.go"
+	if hasTests(src) {
+		pattern = "gore_eval_*_test.go" // see compile
+	}
+	fh, err := os.CreateTemp(tmpdir, pattern)
+	if err != nil {
+		systemFailure("Unable to create temp file", err)
+	}
+	_, err = fh.WriteString(src)
+	if e := fh.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(fh.Name())
+		systemFailure("Unable to write temp file", err)
+	}
+	if opts.Debug != nil {
+		fmt.Fprintf(opts.Debug, "// %s\n%s", fh.Name(), src)
+	}
+	return fh.Name()
+}
+
+func buildMain(topLevel string, nonTopLevel string, pkgsToImport map[string]string, opts Options) string {
 	imports := ""
-	for k, _ := range pkgsToImport {
-		imports += `import "` + k + "\"\n"
+	disambiguate(pkgsToImport)
+	// sorted, to keep the source (and hence the binary cache key) stable
+	for _, k := range sortedPaths(pkgsToImport) {
+		if alias := pkgsToImport[k]; alias != "" {
+			imports += "import " + alias + ` "` + k + "\"\n"
+		} else {
+			imports += `import "` + k + "\"\n"
+		}
+	}
+	helpers := ""
+	used := func(helper string) bool { return strings.Contains(topLevel+nonTopLevel, helper+"(") }
+	p, pretty, typ, dump, check := used("__p"), used("__pp"), used("__t"), used("__d"), used("__e")
+	typeValue, timer := used("__tv"), used("__timer")
+	value, timed, mark, printf := strings.Contains(nonTopLevel, "__value("), used("__timed"), used("__mark"), used("__fmt.Printf") // see Session
+	// The helpers import what they need under names of their own, so they can't clash with
+	// anything the user declares or imports, and only when they're used, so they're never
+	// unused imports
+	if p || pretty || typ || typeValue || dump || value || check || timed || timer || printf {
+		imports += `import __fmt "fmt"` + "\n"
+	}
+	if dump || value {
+		imports += `import __json "encoding/json"` + "\n"
+	}
+	if value || check || mark {
+		imports += `import __os "os"` + "\n"
+	}
+	if p {
+		helpers += printHelper(opts)
+	}
+	if pretty {
+		verb := opts.PrettyVerb
+		if verb == "" {
+			verb = "%#v"
+		}
+		helpers += fmt.Sprintf(prettyHelper, verb)
+	}
+	if typ {
+		helpers += typeHelper
+	}
+	if typeValue {
+		helpers += typeValueHelper
 	}
-	template := `
+	if dump {
+		helpers += dumpHelper
+	}
+	if value {
+		helpers += valueHelper
+	}
+	if check {
+		helpers += checkHelper
+	}
+	if timed || timer {
+		imports += `import __time "time"` + "\n"
+	}
+	if timed {
+		helpers += timedHelper
+	}
+	if timer {
+		helpers += timerHelper
+	}
+	header, seed := randSeed(topLevel, pkgsToImport, opts)
+	template := header + `
 package main
 %s
 %s
 func main() {
-%s
+` + seed + `%s
 }
 
-func __p(values ...interface{}){
-	for _, v := range values {
-             fmt.Printf("%%+v\n", v)
-	}
-}
-func __t(values ...interface{}){
-	for _, v := range values {
-             fmt.Printf("%%T\n", v)
-	}
-}
 `
-	return fmt.Sprintf(template, imports, topLevel, nonTopLevel)
+	return formatSource(fmt.Sprintf(template, imports, topLevel, nonTopLevel) + helpers)
 }
 
-// Functions for converting the input string into a series of chunks.
-//====================================================================
+// With Options.RandSeed, the statement that seeds math/rand, if the program imports it, and the
+// directive that keeps rand.Seed from being a no-op (as it is by default since Go 1.24)
+func randSeed(topLevel string, pkgsToImport map[string]string, opts Options) (header string, seed string) {
+	if opts.RandSeed == 0 {
+		return "", ""
+	}
+	name := ""
+	if alias, ok := pkgsToImport["math/rand"]; ok {
+		name = alias
+		if name == "" {
+			name = "rand"
+		}
+	}
+	for _, imp := range userImports(topLevel) {
+		if imp.path == "math/rand" && imp.name != "_" && imp.name != "." {
+			name = imp.name
+		}
+	}
+	if name == "" {
+		return "", ""
+	}
+	return "//go:debug randseednop=0", fmt.Sprintf("%s.Seed(%d)\n", name, opts.RandSeed)
+}
 
-// Extract the next chunk from input. In case of an err, we attempt to
-// package whatever's read so far into a chunk. After the final chunk is
-// returned, the subsequent call to nextChunk returns an err=io.EOF indication
-func nextChunk(scanner *Scanner) (chunk Chunk, err error) {
-	// mark the current position. Used by mkChunk to extract a slice from
-	// the input, starting from mark to the current read head
-	mark := scanner.Mark()
-	ch, err := scanner.ReadRune()
+var indentedLinePat = regexp.MustCompile(`(?m)^[ \t]+(//line .*:\d+)$`)
 
+// Format src as gofmt would, so that the generated file is readable. If src doesn't parse, it's
+// returned as is, and the compiler explains what's wrong with it.
+func formatSource(src string) string {
+	buf, err := format.Source([]byte(src))
 	if err != nil {
-		return chunk, err
+		return src
 	}
+	// gofmt indents the "//line" pragmas along with the code, but the compiler only honors them
+	// at the start of a line
+	return renumber(src, indentedLinePat.ReplaceAllString(string(buf), "$1"))
+}
+
+var pragmaLinePat = regexp.MustCompile(`(?m)^//line (.*):(\d+)$`)
 
-	switch ch {
-	case '/':
-		// Is this the start of a single or multi-line comment?
-		ch, err = scanner.ReadRune()
+// gofmt can move code to other lines than the "//line" pragmas in src say it's on, as when it
+// splits "x := 1; y := 2" in two. Add a pragma to formatted before each line that has moved,
+// with the line it came from.
+func renumber(src, formatted string) string {
+	nodes := func(src string) (fset *token.FileSet, nodes []ast.Node) {
+		fset = token.NewFileSet()
+		f, err := parser.ParseFile(fset, "", src, parser.ParseComments|parser.SkipObjectResolution)
 		if err != nil {
-			return mkChunk(mark, scanner, KCOMMENT, 0, err)
+			return nil, nil
 		}
-		switch ch {
-		case '/':
-			return readSingleLineComment(mark, scanner)
-		case '*':
-			return readMultilineComment(mark, scanner)
-		default:
-			return readText(mark, scanner)
-		}
-	case '"', '\'':
-		return readString(mark, scanner, ch)
-	case '`':
-		return readMultilineString(mark, scanner)
-	case '\n': // empty line
-		return mkChunk(mark, scanner, KTEXT, 1, err)
-	default:
-		return readText(mark, scanner)
-	}
-	return
-}
-
-func readSingleLineComment(mark int, scanner *Scanner) (chunk Chunk, err error) {
-	for {
-		ch, err := scanner.ReadRune()
-		if err != nil || ch == '\n' { // EOL or EOF or some other error, we'll package up what we have so far
-			return mkChunk(mark, scanner, KCOMMENT, 1, err)
+		ast.Inspect(f, func(n ast.Node) bool {
+			if n != nil {
+				nodes = append(nodes, n)
+			}
+			return true
+		})
+		return fset, nodes
+	}
+	srcSet, srcNodes := nodes(src)
+	fmtSet, fmtNodes := nodes(formatted)
+	if len(srcNodes) == 0 || len(srcNodes) != len(fmtNodes) { // say gofmt sorted some imports
+		return formatted
+	}
+	// The pragmas in src, by offset, and the file each names
+	var pragmas []int
+	files := make(map[int]string)
+	for _, m := range pragmaLinePat.FindAllStringSubmatchIndex(src, -1) {
+		pragmas = append(pragmas, m[0])
+		files[m[0]] = src[m[2]:m[3]]
+	}
+	fmtLines := strings.Split(formatted, "\n")
+	// Where the code that begins each line of formatted came from, for the lines that begin
+	// with code after a pragma
+	type origin struct {
+		file string
+		line int
+	}
+	origins := make(map[int]origin)
+	for i, n := range srcNodes {
+		offset := srcSet.Position(n.Pos()).Offset
+		k := sort.SearchInts(pragmas, offset+1) - 1 // the last pragma before the node
+		pos := fmtSet.PositionFor(fmtNodes[i].Pos(), false)
+		if _, ok := origins[pos.Line]; ok || k < 0 {
+			continue
 		}
+		if line := fmtLines[pos.Line-1]; len(strings.TrimLeft(line, " \t")) != len(line)-pos.Column+1 {
+			continue // not the first thing on its line, which may be in a string or comment
+		}
+		origins[pos.Line] = origin{files[pragmas[k]], srcSet.PositionFor(n.Pos(), true).Line}
 	}
-	return // dummy
-}
-
-func readMultilineComment(mark int, scanner *Scanner) (chunk Chunk, err error) {
-	// "/*" has already been consumed. Read until EOF or until "*/", and count num of lines
-	numLines := 0
-	for {
-		ch, err := scanner.ReadRune()
-		if err != nil { // EOF or some other error, we'll package up what we have so far
-			return mkChunk(mark, scanner, KCOMMENT, numLines, err)
+	var b strings.Builder
+	file, line := "", 1 // where the compiler takes the next line to be from
+	for i, text := range fmtLines {
+		if m := pragmaLinePat.FindStringSubmatch(text); m != nil {
+			b.WriteString(text + "\n")
+			file, line = m[1], 0
+			fmt.Sscan(m[2], &line)
+			continue
 		}
-		switch ch {
-		case '*':
-			ch, err = scanner.ReadRune()
-			if err != nil || ch == '/' {
-				return mkChunk(mark, scanner, KCOMMENT, numLines, err)
-			}
-		case '\n':
-			numLines++
+		if o, ok := origins[i+1]; ok && (o.file != file || o.line != line) {
+			fmt.Fprintf(&b, "//line %s:%d\n", o.file, o.line)
+			file, line = o.file, o.line
 		}
+		b.WriteString(text)
+		if i < len(fmtLines)-1 {
+			b.WriteString("\n")
+		}
+		line++
 	}
-	return
+	return b.String()
 }
 
-func readString(mark int, scanner *Scanner, endCh rune) (chunk Chunk, err error) {
-	// Looking for endCh (single or double quote) while taking care of escapes
-	for {
-		ch, err := scanner.ReadRune()
-		if err != nil { // EOL or EOF or some other error, we'll package up what we have so far
-			return mkChunk(mark, scanner, KSTRING, 0, err)
-		}
-		if ch == endCh {
-			return mkChunk(mark, scanner, KSTRING, 0, nil)
-		} else if ch == '\\' {
-			scanner.ReadRune() // read past next char
-		} else if ch == '\n' {
-			panic("Newline in string @ " + string(scanner.Pos()))
+// __p prints each value on a line of its own or, with Options.PrintInline, all of them on one
+// line, separated by Options.PrintSeparator
+func printHelper(opts Options) string {
+	verb := printVerb(opts)
+	if !opts.PrintInline {
+		return fmt.Sprintf(`func __p(values ...interface{}){
+	for _, v := range values {
+             __fmt.Printf(%q, v)
+	}
+}
+`, verb+"\n")
+	}
+	sep := opts.PrintSeparator
+	if sep == "" {
+		sep = " "
+	}
+	return fmt.Sprintf(`func __p(values ...interface{}){
+	for i, v := range values {
+		if i > 0 {
+			__fmt.Print(%q)
 		}
+		__fmt.Printf(%q, v)
 	}
-	return // dummy
+	__fmt.Println()
+}
+`, sep, verb)
 }
 
-func readMultilineString(mark int, scanner *Scanner) (chunk Chunk, err error) {
-	numLines := 0
-	for {
-		ch, err := scanner.ReadRune()
-		if err != nil { // EOF or some other error, we'll package up what we have so far
-			return mkChunk(mark, scanner, KSTRING, 1, err)
-		}
-		switch ch {
-		case '`':
-			return mkChunk(mark, scanner, KSTRING, numLines, nil)
-		case '\n':
-			numLines++
-		}
+// The verb for __p: Options.PrintVerb, else $GORE_PRINT_VERB, else "%+v"
+func printVerb(opts Options) string {
+	if opts.PrintVerb != "" {
+		return opts.PrintVerb
 	}
-	return // dummy
+	if verb := os.Getenv("GORE_PRINT_VERB"); verb != "" {
+		return verb
+	}
+	return "%+v"
 }
 
-func readText(mark int, scanner *Scanner) (chunk Chunk, err error) {
-	// read until EOL or EOF or string or possible beginning of comment
-	for {
-		ch, err := scanner.ReadRune()
-		if err != nil { // EOF or some other error, we'll package up what we have so far
-			return mkChunk(mark, scanner, KTEXT, 0, err)
+// __pp prints each value on a line of its own with Options.PrettyVerb, given as the argument
+const prettyHelper = `func __pp(values ...interface{}){
+	for _, v := range values {
+             __fmt.Printf(%q+"\n", v)
+	}
+}
+`
+
+// __t prints the type of each value on a line of its own
+const typeHelper = `func __t(values ...interface{}){
+	for _, v := range values {
+             __fmt.Printf("%T\n", v)
+	}
+}
+`
+
+// __tv prints the type and value of each value on a line of its own
+const typeValueHelper = `func __tv(values ...interface{}){
+	for _, v := range values {
+             __fmt.Printf("%T = %+v\n", v, v)
+	}
+}
+`
+
+// __value saves the results of an expression where run can find them. See Options.CaptureValue
+const valueHelper = `func __value(values ...interface{}){
+	var v interface{} = values
+	if len(values) == 1 {
+		v = values[0]
+	}
+	var res struct {
+		Type string
+		JSON __json.RawMessage "json:\",omitempty\""
+		Text string
+	}
+	for i, x := range values {
+		if i > 0 {
+			res.Type, res.Text = res.Type+", ", res.Text+" "
 		}
-		switch ch {
-		case '/':
-			slashMark := scanner.Mark()
-			ch, err = scanner.ReadRune()
-			if ch == '*' || ch == '/' {
-				// it is a comment.
-				scanner.Reset(slashMark + 1) // The +1 is to unread the original slash as well
-				return mkChunk(mark, scanner, KTEXT, 0, nil)
-			}
-		case '`', '"', '\'':
-			scanner.UnreadRune() //  nextChunk will reprocess this character
-			return mkChunk(mark, scanner, KTEXT, 0, nil)
-		case '\n':
-			return mkChunk(mark, scanner, KTEXT, 1, nil)
+		res.Type, res.Text = res.Type+__fmt.Sprintf("%T", x), res.Text+__fmt.Sprintf("%+v", x)
+	}
+	if len(values) != 1 {
+		res.Type = "(" + res.Type + ")"
+	}
+	if b, err := __json.Marshal(v); err == nil {
+		res.JSON = b
+	}
+	if b, err := __json.Marshal(res); err == nil {
+		__os.WriteFile(__os.Getenv("` + valueFileEnv + `"), b, 0600)
+	}
+}
+`
+
+// __d prints each value as indented JSON, or as __p would if it can't be marshaled
+const dumpHelper = `func __d(values ...interface{}){
+	for _, v := range values {
+		if b, err := __json.MarshalIndent(v, "", "  "); err == nil {
+			__fmt.Println(string(b))
+		} else {
+			__fmt.Printf("%+v\n", v)
 		}
 	}
-	return
 }
+`
 
-func mkChunk(mark int, scanner *Scanner, kind int, numLines int, err error) (chunk Chunk, e error) {
-	text := scanner.Slice(mark)
-	if len(text) > 0 && err == io.EOF {
-		err = nil // Delay the EOF until this chunk is processed;  Will get an EOF the next time
+// __e prints a non-nil error to stderr and ends the program with exit status 1. Taking a single
+// error, it can only be called with something that returns just an error.
+const checkHelper = `func __e(err error){
+	if err != nil {
+		__fmt.Fprintln(__os.Stderr, err)
+		__os.Exit(1)
 	}
-	chunk = Chunk{text: text, kind: kind, numNL: numLines}
-	//fmt.Printf("CHUNK : <<%+v>>\n", chunk)
-	return chunk, err
 }
+`
+
+// __timed runs f and prints how long it took
+const timedHelper = `func __timed(f func()){
+	start := __time.Now()
+	f()
+	__fmt.Println(__time.Since(start))
+}
+`
+
+// __timer times a statement that declares variables, which can't go in __timed's func: calling
+// the func it returns prints how long it's been
+const timerHelper = `func __timer() func(){
+	start := __time.Now()
+	return func(){ __fmt.Println(__time.Since(start)) }
+}
+`
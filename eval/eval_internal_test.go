@@ -0,0 +1,118 @@
+package eval
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPkgName(t *testing.T) {
+	for path, name := range map[string]string{
+		"fmt":                  "fmt",
+		"math/rand":            "rand",
+		"math/rand/v2":         "rand",
+		"github.com/x/y/v2":    "y",
+		"gopkg.in/yaml.v3":     "yaml",
+		"example.com/v2sender": "v2sender",
+	} {
+		if got := pkgName(path); got != name {
+			t.Errorf("Expected pkgName(%q) to be %q, got %q", path, name, got)
+		}
+	}
+}
+
+func TestDisambiguate(t *testing.T) {
+	pkgs := map[string]string{"math/rand": "", "crypto/rand": "", "text/template": "", "html/template": "template", "fmt": ""}
+	disambiguate(pkgs)
+	expected := map[string]string{"math/rand": "mathrand", "crypto/rand": "", "text/template": "texttemplate", "html/template": "template", "fmt": ""}
+	for path, alias := range expected {
+		if pkgs[path] != alias {
+			t.Errorf("Expected %s to be imported as %q, got %q", path, alias, pkgs[path])
+		}
+	}
+}
+
+func TestInferPackages(t *testing.T) {
+	for code, expected := range map[string]string{
+		"b := &bytes.Buffer{}":                         "bytes",
+		"m := map[string]json.RawMessage{}":            "encoding/json",
+		"f(1,strings.ToUpper(s))":                      "strings",
+		"x := []any{os.Args}":                          "os",
+		"type T struct { t time.Time; r io.Reader }":   "io time",
+		"f := slices.Index[[]int]":                     "slices",
+		"switch v := x.(type) { case *bytes.Buffer: }": "bytes",
+		"r, ok := x.(io.Reader)":                       "io",
+		"case io.EOF:":                                 "io",
+		"case *os.File, json.Number:":                  "encoding/json os",
+		"reflect.TypeOf((*fmt.Stringer)(nil)).Elem()":  "fmt reflect",
+		"if _, ok := err.(*fs.PathError); ok {":        "io/fs",
+		"n := x.bytes.Len()":                           "",
+		"a.b.sort.Strings(s)":                          "",
+		"http.DefaultClient.Timeout = 5 * time.Second": "net/http time",
+		"os.Stdout.Write(b)":                           "os",
+		"json.Unmarshal(b, &cfg.Value)":                "encoding/json",
+		"x.Timeout, y = 5*time.Second, strings.Fields": "strings time",
+	} {
+		pkgs := make(map[string]string)
+		inferPackages(code, pkgs, make(map[string]bool), "")
+		if got := strings.Join(sortedPaths(pkgs), " "); got != expected {
+			t.Errorf("Expected %q to import %q, got %q", code, expected, got)
+		}
+	}
+}
+
+func TestInferPackagesSkipsLocals(t *testing.T) {
+	for code, expected := range map[string]string{
+		"log := newLogger(); log.Info()":               "",
+		"log.Print(1); log := newLogger(); log.Info()": "log",
+		"var a, log = 1, f(); log.Info()":              "",
+		"for i, path := range paths { path.Join() }":   "",
+		"x, sort := 1, 2; strings.Join(sort.x)":        "strings",
+		"bufio := cfg(); bufio.Size = 4096":            "",
+		"var sort sorter; sort.Less = less":            "",
+		"buf := bytes.Buffer{}; buf.Len, x = 1, 2":     "bytes",
+		"log, err := open(); log.Out = os.Stderr":      "os",
+	} {
+		pkgs := make(map[string]string)
+		inferPackages(code, pkgs, make(map[string]bool), "")
+		if got := strings.Join(sortedPaths(pkgs), " "); got != expected {
+			t.Errorf("Expected %q to import %q, got %q", code, expected, got)
+		}
+	}
+
+	// Declared on an earlier line
+	pkgs := make(map[string]string)
+	locals := make(map[string]bool)
+	inferPackages("errors := check()", pkgs, locals, "")
+	inferPackages("errors.Report()", pkgs, locals, "")
+	if len(pkgs) != 0 {
+		t.Errorf("Expected nothing to be imported, got %v", pkgs)
+	}
+}
+
+// Compiler output captured from go1.27, and some from older releases
+func TestRepairImports(t *testing.T) {
+	for err, removed := range map[string]string{
+		`./gore_eval.go:3:8: "math" imported and not used`:                                                                     "math",
+		`./gore_eval.go:4:8: "math/rand" imported as mr and not used`:                                                          "math/rand",
+		`./gore_eval.go:5:8: "text/template" imported and not used`:                                                            "text/template",
+		":6: math already declared through import of package math (\"math\")\n\t./gore_eval.go:3:8: other declaration of math": "math",
+		"./gore_eval.go:3:8: fmt redeclared in this block\n\t./gore_eval.go:2:8: other declaration of fmt":                     "fmt",
+		`/tmp/gore_eval.go:4: imported and not used: "os"`:                                                                     "os",
+		`:4: os redeclared as imported package name`:                                                                           "os",
+	} {
+		pkgs := map[string]string{"fmt": "", "math": "", "math/rand": "mr", "text/template": "", "os": ""}
+		if !repairImports(err, pkgs) {
+			t.Errorf("Expected a repair for %q", err)
+		}
+		if _, ok := pkgs[removed]; ok || len(pkgs) != 4 {
+			t.Errorf("Expected only %s to be removed for %q, got %v", removed, err, pkgs)
+		}
+	}
+	if repairImports(`:3: undefined: x`, map[string]string{"fmt": ""}) {
+		t.Errorf("Expected no repair for an unrelated error")
+	}
+	pkgs := map[string]string{"net/http/pprof": "_", "strings": "."}
+	if repairImports("./gore_eval.go:3:8: \"strings\" imported and not used", pkgs) || len(pkgs) != 2 {
+		t.Errorf("Expected dot and blank imports to be left alone, got %v", pkgs)
+	}
+}
@@ -1,10 +1,21 @@
 package eval_test
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"github.com/sriram-srinivasan/gore/eval"
+	"github.com/theclapp/gore/eval"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestSimple(t *testing.T) {
@@ -48,7 +59,7 @@ func TestMultilineError(t *testing.T) {
              foo := 10
              math.log(100) // Using log instead of Log to provoke error
         `
-	check(t, code, "", ":3: cannot refer to unexported name math.log")
+	check(t, code, "", ":3: undefined: math.log")
 }
 
 func TestImportRepair(t *testing.T) {
@@ -62,6 +73,9 @@ func TestImportRepair(t *testing.T) {
         p math.x
         `
 	check(t, code, "100", "")
+
+	// Each repair reveals the next problem: first the unused "time", then the wrong rand
+	check(t, "func twice(time int) int { return time * 2 }\np twice(len(rand.Text()))", "52", "")
 }
 
 func TestAliases(t *testing.T) {
@@ -76,6 +90,265 @@ func TestAliases(t *testing.T) {
             t t()
         `
 	check(t, code, "10\nint\n", "")
+
+	// The helpers don't depend on the name fmt
+	check(t, "type fmt struct{ s string }\np fmt{\"ok\"}\npp 1", "{s:ok}\n1", "")
+}
+
+func TestAliasesInBlocks(t *testing.T) {
+	code := `
+            func show(xs []int) {
+                for _, x := range xs {
+                    if x > 1 {
+                        p x
+                    }
+                }
+            }
+            show([]int{1, 2, 3})
+            x := 4; p x
+            y := 5; p y; p x+y // the sum
+            s := "a; p x"; p s
+            for p := 0; p < 2; p++ { fmt.Println(p) }
+            type pair struct{ n int; t string }
+            t pair{}
+            tv 1 /* one */
+        `
+	check(t, code, "2\n3\n4\n5\n9\na; p x\n0\n1\nmain.pair\nint = 1\n", "")
+
+	// With a func literal, the arguments end with the block
+	check(t, "func run(f func()) { f() }\nrun(func() { x := 6; p x })", "6\n", "")
+
+	// A block can begin on the line, too, though a composite literal or a struct type can't
+	code = `
+            if true { p 1 }
+            for i := 0; i < 1; i++ {  p i }
+            if false { p 2 } else { p 3 }
+            func four() { p 4 }
+            four()
+            { p 5 }
+            xs := []string{"p 6"}; p xs
+            type pt struct{ p int }
+            p pt{p: 7}
+        `
+	check(t, code, "1\n0\n3\n4\n5\n[p 6]\n{p:7}\n", "")
+}
+
+// An alias still expands after a variable of the same name has been declared: "p x" is not
+// valid Go whatever p is, so it can only mean the alias
+func TestAliasAfterAssignment(t *testing.T) {
+	code := `
+            p := strings.ToUpper
+            p p("shadowed")
+        `
+	check(t, code, "SHADOWED", "")
+}
+
+// init functions are top-level funcs like any other, and run before the rest of the snippet
+func TestInit(t *testing.T) {
+	code := `
+            p "main"
+            func init() { os.Setenv("GORE_INIT", "set by init") }
+            p os.Getenv("GORE_INIT")
+            func init() { println("second init") }
+        `
+	check(t, code, "second init\nmain\nset by init\n", "")
+}
+
+func TestAutoPrint(t *testing.T) {
+	opts := eval.DefaultOptions()
+	opts.AutoPrint = true
+	out, err := eval.EvalWithOptions(`
+            2 + 3
+            strings.ToUpper("hi")
+            fmt.Println("printed once")
+            func nothing() {}
+            nothing()
+            x := []int{1, 2}
+            x
+        `, opts)
+	if ts(out) != "5\nHI\nprinted once\n[1 2]" || err != "" {
+		t.Errorf("Expected bare expressions to be printed, got %q and error %q", out, err)
+	}
+
+	// Only the top level of main is echoed
+	_, err = eval.EvalWithOptions("if true {\n    2 + 3\n}", opts)
+	if !strings.Contains(err, ":2: 2 + 3 (untyped int constant 5) is not used") {
+		t.Errorf("Expected a nested expression to be left alone, got error %q", err)
+	}
+}
+
+func TestPrintInline(t *testing.T) {
+	code := `
+            type A struct {
+                S string
+                V int
+            }
+            a := A{S: "The answer is", V: 42}
+            p "a = ", a
+            p 1, 2, 3
+        `
+	check(t, code, "a = \n{S:The answer is V:42}\n1\n2\n3\n", "")
+
+	opts := eval.DefaultOptions()
+	opts.PrintInline = true
+	out, err := eval.EvalWithOptions(code, opts)
+	if out != "a =  {S:The answer is V:42}\n1 2 3\n" || err != "" {
+		t.Errorf("Expected the values of each p on one line, got %q and error %q", out, err)
+	}
+
+	opts.PrintSeparator = ", "
+	out, err = eval.EvalWithOptions(`p 1, 2, 3`, opts)
+	if out != "1, 2, 3\n" || err != "" {
+		t.Errorf("Expected the values separated by commas, got %q and error %q", out, err)
+	}
+}
+
+func TestPrintVerb(t *testing.T) {
+	code := `
+            type A struct{ S string }
+            p A{"x"}, "y"
+        `
+	opts := eval.DefaultOptions()
+	opts.PrintVerb = "%v"
+	if out, err := eval.EvalWithOptions(code, opts); out != "{x}\ny\n" || err != "" {
+		t.Errorf("Expected the values printed with %%v, got %q and error %q", out, err)
+	}
+	opts.PrintInline = true
+	if out, err := eval.EvalWithOptions(code, opts); out != "{x} y\n" || err != "" {
+		t.Errorf("Expected the values printed inline with %%v, got %q and error %q", out, err)
+	}
+
+	t.Setenv("GORE_PRINT_VERB", "%#v")
+	if out, err := eval.Eval(code); out != "main.A{S:\"x\"}\n\"y\"\n" || err != "" {
+		t.Errorf("Expected $GORE_PRINT_VERB to be used, got %q and error %q", out, err)
+	}
+	if out, err := eval.EvalWithOptions(code, opts); out != "{x} y\n" || err != "" {
+		t.Errorf("Expected Options.PrintVerb to override $GORE_PRINT_VERB, got %q and error %q", out, err)
+	}
+}
+
+func TestPrettyPrint(t *testing.T) {
+	code := `
+            pp []string{"a", "b"}, map[string]int{"x": 1}
+            type point struct{ x, y int }
+            pp point{1, 2}
+            pp := 3
+            p pp
+        `
+	check(t, code, "[]string{\"a\", \"b\"}\nmap[string]int{\"x\":1}\nmain.point{x:1, y:2}\n3", "")
+
+	opts := eval.DefaultOptions()
+	opts.PrettyVerb = "%q"
+	out, err := eval.EvalWithOptions(`pp "a", 'b'`, opts)
+	if ts(out) != "\"a\"\n'b'" || err != "" {
+		t.Errorf("Expected output quoted with %%q, got %q and error %q", out, err)
+	}
+}
+
+func TestTypeValue(t *testing.T) {
+	code := `
+            type point struct{ x, y int }
+            tv 3, "a", point{1, 2}
+            tv := 4
+            t tv
+        `
+	check(t, code, "int = 3\nstring = a\nmain.point = {x:1 y:2}\nint", "")
+}
+
+func TestDump(t *testing.T) {
+	code := `
+            type point struct{ X, Y int }
+            d map[string][]point{"a": {{1, 2}}}
+            d func() {}
+        `
+	check(t, code, `{
+  "a": [
+    {
+      "X": 1,
+      "Y": 2
+    }
+  ]
+}
+0x`, "")
+
+	// json is only imported when d is used, so a variable of that name is fine either way
+	check(t, "json := 1\np json", "1", "")
+	check(t, "json := 1\nd json", "1", "")
+
+	// Nor is d an alias where it's a variable being assigned to or changed
+	code = `
+            d := 1
+            d += 2
+            d ++
+            d --
+            d *= 5
+            d <<= 1
+            p d
+            d = 0
+            p d == 0, d != 1, d <= 0, d >= 0
+        `
+	check(t, code, "30\ntrue\ntrue\ntrue\ntrue\n", "")
+	check(t, "d := []int{0, 1}\nd [0] = 2\nd [1] = d[1] + 1\np d", "[2 2]\n", "")
+	check(t, "type pt struct{ x int }\nd := pt{}\nd .x = 3\np d.x", "3\n", "")
+	check(t, "d := map[string]int{}\nd [\"a==b\"] = 1\np d", "map[a==b:1]\n", "")
+	// It still is before a number, a receive or a slice literal
+	check(t, "d .5\nc := make(chan int, 1)\nc <- 1\nd <-c\nd []int{1}", "0.5\n1\n[\n  1\n]\n", "")
+}
+
+func TestRenamedAliases(t *testing.T) {
+	opts := eval.DefaultOptions()
+	opts.Aliases.Print = "show"
+	opts.Aliases.Type = ""
+	out, err := eval.EvalWithOptions(`
+            p := 10
+            show p
+            t := 20
+            show t
+        `, opts)
+	if ts(out) != "10\n20" || err != "" {
+		t.Errorf("Expected output 10 and 20, got %q and error %q", out, err)
+	}
+
+	_, err = eval.EvalWithOptions(`p 10`, eval.Options{})
+	if !strings.Contains(err, "syntax error") {
+		t.Errorf("Expected a syntax error with aliases disabled, got %q", err)
+	}
+}
+
+func TestRegisterAlias(t *testing.T) {
+	eval.RegisterAlias("j", func(args string) string { return "__d(" + args + ")" })
+	eval.RegisterAlias("p", func(args string) string { return `fmt.Println("p:", ` + args + ")" })
+	defer eval.RegisterAlias("j", nil)
+	defer eval.RegisterAlias("p", nil)
+	check(t, `
+            j map[string]int{"a": 1}
+            if true {
+                p 1, 2
+            }
+            j := 3
+            p j
+        `, "{\n  \"a\": 1\n}\np: 1 2\np: 3\n", "")
+
+	_, errs := eval.EvalStructured("j 1\n\np undefinedName")
+	if len(errs) != 1 || errs[0].Line != 3 {
+		t.Errorf("Expected an error on line 3, got %v", errs)
+	}
+
+	eval.RegisterAlias("p", nil)
+	check(t, "p 7", "7\n", "")
+}
+
+func TestVerbose(t *testing.T) {
+	opts := eval.DefaultOptions()
+	opts.Verbose = true
+	_, err := eval.EvalWithOptions(`
+            type Clock struct{ hour int }
+            func hour(time Clock) int { return time.hour }
+            p strings.Repeat("!", hour(Clock{12})), undefinedName
+        `, opts)
+	if !strings.Contains(err, "auto-imported: strings, time; removed after retry: time") {
+		t.Errorf("Expected a report of imported packages, got:\n%s", err)
+	}
 }
 
 func TestPartitioning(t *testing.T) {
@@ -97,6 +370,35 @@ func TestPartitioning(t *testing.T) {
 	check(t, code, "TestPartitioning\nbar\ntrue\n{a:10 b:true}", "")
 }
 
+func TestGenerics(t *testing.T) {
+	code := `
+          type Stack[T any] struct {
+              items []T
+          }
+          func (s *Stack[T]) Push(x T) { s.items = append(s.items, x) }
+          func Map[
+              T, U any,
+          ](xs []T, f func(T) U) []U {
+              var out []U
+              for _, x := range xs {
+                  out = append(out, f(x))
+              }
+              return out
+          }
+          s := &Stack[int]{}
+          s.Push(3)
+          s.Push(1)
+          s.Push(2)
+          slices.Sort[[]int](s.items)
+          p s.items
+          stars := Map(s.items, func(i int) string {
+              return strings.Repeat("*", i)
+          })
+          p stars
+         `
+	check(t, code, "[1 2 3]\n[* ** ***]\n", "")
+}
+
 func TestStrings(t *testing.T) {
 	// Inside a double quoted string, it should be ok to have:
 	//   1. expressions of the form abc.foo, where abc is not mistakenly interpreted to be a package name
@@ -117,6 +419,76 @@ string /**/`
 	check(t, code, out, "")
 }
 
+// A raw string that ends the snippet, with or without a newline after it
+func TestRawStringAtEnd(t *testing.T) {
+	for _, end := range []string{"", "\n"} {
+		code := "x := 1\ns := `a\n\nb`" + end
+		_, nonTopLevel, _, err := eval.Partition(code)
+		if err != nil || !strings.Contains(nonTopLevel, "//line :2\ns := `a\n\nb`") {
+			t.Errorf("Partitioning %q: expected the whole string on line 2, got %q and error %v", code, nonTopLevel, err)
+		}
+		check(t, "p `a\n\nb`"+end, "a\n\nb", "")
+		check(t, "s := `a\np s\n`; p s, undefinedName"+end, "", ":3: undefined: undefinedName")
+		check(t, "print(`a\np s`)"+end, "a\np s", "") // no alias inside the string
+	}
+}
+
+// An error on line K of the input is reported on line K, whatever precedes it
+func TestLineNumbers(t *testing.T) {
+	for code, line := range map[string]int{
+		"\n\nx := undefinedName":                                               3,
+		"\n\np undefinedName":                                                  3,
+		"\n  \t\n\tp undefinedName":                                            3,
+		"p 1\n\n\np undefinedName\n\n":                                         4,
+		"// comment\nx := undefinedName":                                       2,
+		"/* a\nb */\nx := undefinedName":                                       3,
+		"s := `a\nb`\n_ = s\np undefinedName":                                  4,
+		"func f() {\n}\n\np undefinedName":                                     4,
+		"type T struct{}\n\n// doc\nfunc f() int {\n\treturn undefinedName\n}": 5,
+		"x := 1 /* multi\nline */ + undefinedName":                             2,
+		"x := 1; y := undefinedName":                                           1,
+		"s := `a\nb`; _ = undefinedName":                                       2,
+	} {
+		_, errs := eval.EvalStructured(code)
+		found := false
+		for _, e := range errs {
+			found = found || e.Line == line && strings.Contains(e.Msg, "undefined: undefinedName")
+		}
+		if !found {
+			t.Errorf("Evaluating %q: expected undefinedName to be reported on line %d, got %v", code, line, errs)
+		}
+	}
+}
+
+// a raw newline inside a double-quoted string is reported with its line number
+func TestNewlineInString(t *testing.T) {
+	code := "x := 1\ny := \"abc\n\"\np x, y\n"
+	check(t, code, "", ":2: newline in string literal")
+}
+
+func TestCRLF(t *testing.T) {
+	code := "x := 1 // one\r\n" +
+		"/* a\r\n   comment */\r\n" +
+		"s := `raw\r\nstring`\r\n" +
+		"p x, s\r\n" +
+		"t s\r\n"
+	check(t, code, "1\nraw\nstring\nstring\n", "")
+	check(t, "p 1\r\ns := \"a\r\nb\"\r\n", "", ":2: newline in string literal")
+}
+
+func TestRuneLiterals(t *testing.T) {
+	code := `
+             a, b, c, d := 'a', '\n', '\u00e9', '\''
+             p a, b, c, d
+             p math.MaxInt8
+        `
+	check(t, code, "97\n10\n233\n39\n127", "")
+
+	// A stray quote must not swallow the rest of the line, hiding the reference to math
+	code = "x := 'ab + math.Pi\n"
+	check(t, code, "", ":1: newline in rune literal")
+}
+
 // checks that comment chars inside strings are ignored, and that leading and trailing comments don't confuse paren/bracket accounting
 func TestComments(t *testing.T) {
 	code := `
@@ -134,6 +506,22 @@ func TestComments(t *testing.T) {
 	check(t, code, "/* test string {", "")
 }
 
+// A slash that doesn't begin a comment is division, whatever follows it
+func TestDivision(t *testing.T) {
+	code := `
+           a, b := 12, 3
+           pb := &b
+           p a / *pb, a/(*pb)
+           p int('x')/'<', len("abcd")/len("ab")
+           c := a /
+               b
+           p c
+           p undefinedName
+        `
+	check(t, code, "", ":9: undefined: undefinedName")
+	check(t, strings.Replace(code, "p undefinedName", "", 1), "4\n4\n2\n2\n4", "")
+}
+
 // check that line numbers of compiler errors are not thrown off by multiline comments
 func TestCommentsErr(t *testing.T) {
 	code := `
@@ -145,6 +533,1247 @@ func TestCommentsErr(t *testing.T) {
 	check(t, code, "", ":4: undefined: xxx")
 }
 
+// check that each compiler error is reported separately, with the user's line numbers
+func TestStructuredErrors(t *testing.T) {
+	code := `
+         _ = undefinedA
+         _ = undefinedB
+        `
+	_, errs := eval.EvalStructured(code)
+	if len(errs) != 2 {
+		t.Fatalf("Expected 2 errors, got %d: %+v", len(errs), errs)
+	}
+	for i, expected := range []eval.EvalError{{Line: 2, Msg: "undefined: undefinedA"}, {Line: 3, Msg: "undefined: undefinedB"}} {
+		if errs[i].Line != expected.Line || errs[i].Msg != expected.Msg {
+			t.Errorf("Expected error %d to be %+v, got %+v", i, expected, errs[i])
+		}
+	}
+}
+
+func TestSourceName(t *testing.T) {
+	opts := eval.DefaultOptions()
+	opts.SourceName = "scripts/hello.go"
+	for code, expected := range map[string]string{
+		"p 1\n_ = undefinedA":                      "scripts/hello.go:2: undefined: undefinedA",
+		"x := 1\np x\nif x > 0 {":                  "scripts/hello.go:3: Bracket or paren not closed",
+		"package main\nfunc main() { undefinedB }": "scripts/hello.go:2: undefined: undefinedB",
+	} {
+		res := eval.Evaluate(context.Background(), code, opts)
+		if len(res.Errors) != 1 || !strings.HasPrefix(res.Errors[0].Error(), expected) || res.Errors[0].File != opts.SourceName {
+			t.Errorf("Expected %q to fail with %q, got %+v", code, expected, res.Errors)
+		}
+	}
+
+	// Panics name the file in their stack traces, too
+	res := eval.Evaluate(context.Background(), "\npanic(1)", opts)
+	if !strings.Contains(res.Out, "hello.go:2") {
+		t.Errorf("Expected the stack trace to refer to hello.go:2, got %q", res.Out)
+	}
+}
+
+// a runaway snippet must be killed once the context expires
+func TestContextTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := eval.EvalContext(ctx, `for {}`)
+	if !strings.Contains(err, "evaluation cancelled") {
+		t.Errorf("Expected a cancellation error, got:\n%s\n", err)
+	}
+}
+
+func TestEvalWithImports(t *testing.T) {
+	out, err := eval.EvalWithImports(`p str.ToUpper("forced")`, map[string]string{"str": "strings"})
+	if ts(out) != "FORCED" || err != "" {
+		t.Errorf("Expected FORCED, got %q and error %q", out, err)
+	}
+
+	// An explicit import overrides the inferred text/template
+	out, err = eval.EvalWithImports(`t template.HTML("<b>")`, map[string]string{"": "html/template"})
+	if ts(out) != "template.HTML" || err != "" {
+		t.Errorf("Expected template.HTML, got %q and error %q", out, err)
+	}
+}
+
+// Packages the snippet imports itself aren't inferred too, so there's nothing to repair
+func TestLocalsShadowingPackages(t *testing.T) {
+	check(t, `
+            type logger struct{}
+            func (logger) Info() { fmt.Println("info") }
+            log := logger{}
+            log.Info()
+        `, "info\n", "")
+
+	// The local is out of scope where the package is used, so it's imported after all
+	check(t, `
+            func f() { log := 1; _ = log }
+            f()
+            log.SetFlags(0)
+            log.SetOutput(os.Stdout)
+            log.Print("logged")
+        `, "logged\n", "")
+
+	// Packages and locals on the left of an assignment
+	check(t, `
+            http.DefaultClient.Timeout = 5 * time.Second
+            type config struct{ Size int }
+            bufio := config{}
+            bufio.Size = 4096
+            p http.DefaultClient.Timeout, bufio.Size
+        `, "5s\n4096\n", "")
+}
+
+func TestInferTypeSwitches(t *testing.T) {
+	check(t, `
+            var x any = &bytes.Buffer{}
+            switch x.(type) {
+            case *strings.Builder:
+                p "builder"
+            case io.Reader:
+                p "reader"
+            }
+            _, err := os.Open("/nonexistent/gore")
+            var pathErr *fs.PathError
+            p errors.As(err, &pathErr), reflect.TypeOf(err) == reflect.TypeOf((*fs.PathError)(nil))
+            switch err := (error)(io.EOF); err {
+            case io.EOF:
+                p "EOF"
+            }
+        `, "reader\ntrue\ntrue\nEOF\n", "")
+}
+
+func TestUserImports(t *testing.T) {
+	opts := eval.DefaultOptions()
+	opts.Verbose = true
+	for _, code := range []string{
+		"import \"strings\"\np strings.ToUpper(\"a\")\np undefinedName",
+		"import (\n\t\"fmt\"\n\t\"crypto/rand\"\n)\nb := make([]byte, 4)\nrand.Read(b)\nfmt.Println(len(b))\np undefinedName",
+	} {
+		_, err := eval.EvalWithOptions(code, opts)
+		report := err[strings.Index(err, "auto-imported:"):]
+		if strings.Contains(report, "rand") || strings.Contains(report, "strings") || strings.Contains(report, "removed") {
+			t.Errorf("Evaluating %q: expected the imported packages not to be inferred, got error %q", code, err)
+		}
+		if out, err := eval.Eval(strings.TrimSuffix(code, "\np undefinedName")); err != "" {
+			t.Errorf("Evaluating %q: unexpected error %q (output %q)", code, err, out)
+		}
+	}
+}
+
+func TestBlankAndDotImports(t *testing.T) {
+	check(t, "import _ \"net/http/pprof\"\np 1", "1", "")
+	check(t, "import _ \"net/http/pprof\"\np pprof.Handler(\"heap\") != nil", "true", "")
+	check(t, "import (\n\t_ \"image/png\"\n\t. \"strings\"\n)\np ToUpper(\"a\"), strings.ToLower(\"B\")", "A\nb", "")
+	check(t, "import . \"strings\"\np 1", "", "\"strings\" imported and not used")
+}
+
+func TestNoInferImports(t *testing.T) {
+	opts := eval.DefaultOptions()
+	opts.InferImports = false
+	_, err := eval.EvalWithOptions(`p strings.ToUpper("a")`, opts)
+	if !strings.Contains(err, ":1: undefined: strings") {
+		t.Errorf("Expected strings not to be imported, got error %q", err)
+	}
+
+	opts.Imports = map[string]string{"": "strings"}
+	out, err := eval.EvalWithOptions(`
+                import "math"
+                p strings.ToUpper("a"), math.Sqrt(4)
+                fmt.Println("fmt is always there")
+        `, opts)
+	if ts(out) != "A\n2\nfmt is always there" || err != "" {
+		t.Errorf("Expected explicit imports to work, got %q and error %q", out, err)
+	}
+
+	// fmt is only imported for a snippet that uses it, so neither takes a second build
+	for code, expected := range map[string]string{`println("no fmt")`: "no fmt\n", `fmt.Println("fmt")`: "fmt\n"} {
+		var debug bytes.Buffer
+		opts := eval.DefaultOptions()
+		opts.InferImports = false
+		opts.Debug = &debug
+		res := eval.Evaluate(context.Background(), code, opts)
+		if res.Out != expected || strings.Count(debug.String(), "package main\n") != 1 {
+			t.Errorf("Expected %q to be built once, got %+v\n%s", code, res, debug.String())
+		}
+	}
+}
+
+func TestGoBinAndFlags(t *testing.T) {
+	goBin, e := exec.LookPath("go")
+	if e != nil {
+		t.Skip("no go in PATH")
+	}
+	opts := eval.DefaultOptions()
+	opts.GoBin = goBin
+	opts.BuildFlags = []string{"-ldflags=-X main.greeting=hello"}
+	out, err := eval.EvalWithOptions("package main\nvar greeting string\nfunc main() { println(greeting) }\n", opts)
+	if ts(out) != "hello" || err != "" {
+		t.Errorf("Expected hello, got %q and error %q", out, err)
+	}
+
+	for _, opts.GoBin = range []string{"/nonexistent/go", "gore-no-such-go"} {
+		res := eval.Evaluate(context.Background(), `p 1`, opts)
+		if len(res.Errors) != 1 || res.Errors[0].Kind != eval.SystemError ||
+			!strings.HasPrefix(res.Errors[0].Msg, "go toolchain not found in PATH: ") {
+			t.Errorf("Expected the missing %s to be reported, got %+v", opts.GoBin, res)
+		}
+	}
+}
+
+// The race detector's report is the program's output, not compiler errors to be parsed
+func TestRace(t *testing.T) {
+	opts := eval.DefaultOptions()
+	opts.Race = true
+	res := eval.Evaluate(context.Background(), `
+            x, done := 0, make(chan bool)
+            go func() { x++; done <- true }()
+            x++
+            <-done
+        `, opts)
+	if len(res.Errors) > 0 && strings.Contains(res.Errors[0].Msg, "-race") {
+		t.Skip("no race detector: ", res.Errors[0].Msg)
+	}
+	if res.ExitCode != 66 || len(res.Errors) > 0 || !strings.Contains(res.Out, "WARNING: DATA RACE") ||
+		!strings.Contains(res.Out, "Found 1 data race(s)") {
+		t.Errorf("Expected a race to be reported, got %+v", res)
+	}
+}
+
+func TestCgo(t *testing.T) {
+	if out, err := exec.Command("go", "env", "CGO_ENABLED").Output(); err != nil || strings.TrimSpace(string(out)) != "1" {
+		t.Skip("cgo is disabled")
+	}
+	code := `
+            // #include <stdlib.h>
+            // static int twice(int x) { return 2 * x; }
+            import "C"
+            p C.twice(21)
+            p strings.ToUpper("ok")
+        `
+	if out, err := eval.Eval(code); out != "42\nOK\n" || err != "" {
+		t.Errorf("Expected the preamble to be kept with its import, got %q, %q", out, err)
+	}
+	if _, errs := eval.EvalStructured(code + "\nundefined\n"); len(errs) != 1 || errs[0].Line != 8 {
+		t.Errorf("Expected an error on line 8, got %v", errs)
+	}
+}
+
+func TestStubUndefined(t *testing.T) {
+	code := `
+            total := count + len(names)
+            fmt.Println(total, limit)
+        `
+	opts := eval.DefaultOptions()
+	opts.CompileOnly = true
+	if res := eval.Evaluate(context.Background(), code, opts); len(res.Errors) == 0 || res.Stubbed != nil {
+		t.Errorf("Expected undefined names without StubUndefined, got %+v", res)
+	}
+	opts.StubUndefined = true
+	res := eval.Evaluate(context.Background(), code, opts)
+	if len(res.Errors) != 1 || !strings.Contains(res.Errors[0].Msg, "invalid argument: names") ||
+		strings.Join(res.Stubbed, " ") != "count limit names" {
+		t.Errorf("Expected count, limit and names to be stubbed, got %+v", res)
+	}
+	res = eval.Evaluate(context.Background(), "fmt.Println(limit, strings.ToUpper(`x`))", opts)
+	if len(res.Errors) > 0 || strings.Join(res.Stubbed, " ") != "limit" {
+		t.Errorf("Expected only limit to be stubbed, got %+v", res)
+	}
+}
+
+func TestTransform(t *testing.T) {
+	var seen string
+	opts := eval.DefaultOptions()
+	opts.Transform = func(src string) string {
+		seen = src
+		return strings.Replace(src, "func main() {", "func main() {\n__fmt.Println(\"traced\")", 1)
+	}
+	if out, err := eval.EvalWithOptions("p 1", opts); out != "traced\n1\n" || err != "" {
+		t.Errorf("Expected the transformed program to run, got %q and error %q", out, err)
+	}
+	if !strings.Contains(seen, "__p(1)") {
+		t.Errorf("Expected Transform to be given the generated program, got:\n%s", seen)
+	}
+}
+
+func TestConcurrentEvals(t *testing.T) {
+	opts := eval.DefaultOptions()
+	opts.CacheSize = 0 // force every goroutine to compile
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			out, err := eval.EvalWithOptions(fmt.Sprintf("p %d", i), opts)
+			if ts(out) != fmt.Sprint(i) || err != "" {
+				t.Errorf("Expected %d, got %q and error %q", i, out, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestExitCode(t *testing.T) {
+	res := eval.Evaluate(context.Background(), `
+            p "exiting"
+            os.Exit(3)
+        `, eval.DefaultOptions())
+	if res.ExitCode != 3 || ts(res.Out) != "exiting" || res.Errors != nil {
+		t.Errorf("Expected exit code 3 after printing, got %+v", res)
+	}
+
+	res = eval.Evaluate(context.Background(), `p undefinedName`, eval.DefaultOptions())
+	if res.ExitCode != eval.NotRun || len(res.Errors) == 0 {
+		t.Errorf("Expected a compile error, got %+v", res)
+	}
+}
+
+func TestRuntimePanic(t *testing.T) {
+	code := `
+            var m map[string]int
+            m["a"] = 1
+        `
+	_, err := eval.Eval(code)
+	if !strings.HasPrefix(err, "panic: assignment to entry in nil map\n\ngoroutine 1 [running]:\nmain.main()\n") ||
+		!strings.HasSuffix(err, "\nexit status 2\n") {
+		t.Errorf("Expected the stack trace intact, got %q", err)
+	}
+
+	_, errs := eval.EvalStructured(code)
+	if len(errs) != 1 || errs[0].Kind != eval.RuntimeError || errs[0].Line != 0 {
+		t.Errorf("Expected a single runtime error, got %+v", errs)
+	}
+	_, errs = eval.EvalStructured(`p undefinedName`)
+	if len(errs) != 1 || errs[0].Kind != eval.CompileError {
+		t.Errorf("Expected a compile error, got %+v", errs)
+	}
+}
+
+func TestSeparateOutput(t *testing.T) {
+	opts := eval.DefaultOptions()
+	opts.SeparateOutput = true
+	res := eval.Evaluate(context.Background(), `
+            fmt.Println("to stdout")
+            log.SetFlags(0)
+            log.Print("to stderr")
+        `, opts)
+	if ts(res.Stdout) != "to stdout" || ts(res.Stderr) != "to stderr" || res.ExitCode != 0 {
+		t.Errorf("Expected stdout and stderr to be separate, got %+v", res)
+	}
+
+	res = eval.Evaluate(context.Background(), `p undefinedName`, opts)
+	if res.Stdout != "" || res.Stderr != "" || len(res.Errors) == 0 {
+		t.Errorf("Expected compile errors only in Errors, got %+v", res)
+	}
+}
+
+func TestStdin(t *testing.T) {
+	opts := eval.DefaultOptions()
+	opts.Stdin = strings.NewReader("one\ntwo\n")
+	out, err := eval.EvalWithOptions(`
+            scanner := bufio.NewScanner(os.Stdin)
+            for scanner.Scan() {
+                p strings.ToUpper(scanner.Text())
+            }
+        `, opts)
+	if ts(out) != "ONE\nTWO" || err != "" {
+		t.Errorf("Expected the input in upper case, got %q and error %q", out, err)
+	}
+}
+
+func TestArgs(t *testing.T) {
+	opts := eval.DefaultOptions()
+	opts.Args = []string{"-n", "3", "two words"}
+	out, err := eval.EvalWithOptions(`
+            n := flag.Int("n", 1, "")
+            flag.Parse()
+            p *n, flag.Args()
+        `, opts)
+	if ts(out) != "3\n[two words]" || err != "" {
+		t.Errorf("Expected the arguments to be parsed, got %q and error %q", out, err)
+	}
+}
+
+func TestEnv(t *testing.T) {
+	os.Setenv("GORE_ENV_B", "inherited")
+	defer os.Unsetenv("GORE_ENV_B")
+	opts := eval.DefaultOptions()
+	opts.Env = map[string]string{"GORE_ENV_A": "set", "HOME": "/nowhere"}
+	out, err := eval.EvalWithOptions(`p os.Getenv("GORE_ENV_A"), os.Getenv("GORE_ENV_B"), os.Getenv("HOME")`, opts)
+	if ts(out) != "set\ninherited\n/nowhere" || err != "" {
+		t.Errorf("Expected the variables to be set, got %q and error %q", out, err)
+	}
+	if os.Getenv("GORE_ENV_A") != "" {
+		t.Errorf("Expected this process's environment to be left alone")
+	}
+}
+
+func TestBuiltinPackages(t *testing.T) {
+	pkgs := eval.BuiltinPackages()
+	if pkgs["rand"] != "math/rand" || pkgs["strings"] != "strings" {
+		t.Errorf("Expected rand and strings to be listed, got %v", pkgs)
+	}
+	delete(pkgs, "strings")
+	if eval.BuiltinPackages()["strings"] != "strings" {
+		t.Error("Changing the returned map changed the package table")
+	}
+}
+
+// Packages newer than the built-in list are found with "go list std"
+func TestNewerStdPackages(t *testing.T) {
+	check(t, `p slices.Max([]int{1, 3, 2}), cmp.Compare(1, 2)`, "3\n-1", "")
+}
+
+// rand means math/rand, unless the snippet uses something only another rand package has
+func TestAmbiguousStdPackages(t *testing.T) {
+	check(t, `p rand.New(rand.NewSource(1)).Intn(1) == 0`, "true", "")
+	check(t, `p len(rand.Text())`, "26", "")
+	check(t, `p rand.NoSuchThing`, "", ":1: undefined: rand.NoSuchThing")
+}
+
+func TestCaptureValue(t *testing.T) {
+	opts := eval.DefaultOptions()
+	opts.CaptureValue = true
+	capture := func(code string) *eval.Value {
+		res := eval.Evaluate(context.Background(), code, opts)
+		if len(res.Errors) > 0 {
+			t.Fatalf("Evaluating %q: unexpected errors %v", code, res.Errors)
+		}
+		return res.Value
+	}
+
+	v := capture("type point struct{ X, Y int }\np \"printed\"\npoint{1, 2}")
+	if v == nil || v.Type != "main.point" || string(v.JSON) != `{"X":1,"Y":2}` || v.Text != "{X:1 Y:2}" {
+		t.Errorf("Expected the point, got %+v", v)
+	}
+	if v := capture("strconv.Atoi(\"12\")"); v == nil || v.Type != "(int, <nil>)" || string(v.JSON) != "[12,null]" {
+		t.Errorf("Expected both results, got %+v", v)
+	}
+	if v := capture("func() {}"); v == nil || v.JSON != nil || !strings.HasPrefix(v.Text, "0x") {
+		t.Errorf("Expected a func to be captured as text only, got %+v", v)
+	}
+	if v := capture("x := 1\n_ = x"); v != nil {
+		t.Errorf("Expected no value without a final expression, got %+v", v)
+	}
+	if v := capture("func f() {}\nf()"); v != nil {
+		t.Errorf("Expected no value from a func without results, got %+v", v)
+	}
+}
+
+func TestEvalStream(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	err := eval.EvalStream(`
+            fmt.Println("out")
+            fmt.Fprintln(os.Stderr, "err")
+            os.Exit(4)
+        `, &stdout, &stderr)
+	if ts(stdout.String()) != "out" || ts(stderr.String()) != "err" {
+		t.Errorf("Expected the output to be written to the writers, got %q and %q", stdout.String(), stderr.String())
+	}
+	if errs, ok := err.(eval.EvalErrors); !ok || len(errs) != 1 || errs[0].Kind != eval.RuntimeError ||
+		errs[0].Msg != "exit status 4" {
+		t.Errorf("Expected the exit status as a runtime error, got %#v", err)
+	}
+
+	err = eval.EvalStream(`p undefinedName`, &stdout, &stderr)
+	if err == nil || err.Error() != ":1: undefined: undefinedName" {
+		t.Errorf("Expected a compile error, got %v", err)
+	}
+}
+
+// funcWriter calls itself for each write
+type funcWriter func(p []byte) (int, error)
+
+func (f funcWriter) Write(p []byte) (int, error) { return f(p) }
+
+// Streamed output arrives while the program is still running: it waits for its stdin to be
+// closed, which happens only once the output has been seen
+func TestStreamIsLive(t *testing.T) {
+	r, w := io.Pipe()
+	opts := eval.DefaultOptions()
+	opts.Stdin = r
+	opts.Stdout = funcWriter(func(p []byte) (int, error) {
+		w.Close()
+		return len(p), nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	res := eval.Evaluate(ctx, `
+            fmt.Println("ready")
+            io.ReadAll(os.Stdin)
+        `, opts)
+	if res.Errors != nil || res.ExitCode != 0 {
+		t.Errorf("Expected the program to finish once its output was seen, got %+v", res)
+	}
+}
+
+func TestNonMainPackage(t *testing.T) {
+	res := eval.Evaluate(context.Background(), "package foo\n\nfunc F() int { return 1 }\n", eval.DefaultOptions())
+	if res.Errors != nil || res.ExitCode != eval.NotRun || res.Out != "" {
+		t.Errorf("Expected the package to be compiled but not run, got %+v", res)
+	}
+	check(t, "package foo\n\nfunc F() int { return 1 }\n", "", "")
+	check(t, "package foo\n\nfunc F() int { return x }\n", "", "undefined: x")
+	check(t, "package main\n\nfunc main() { println(\"main\") }\n", "main", "")
+}
+
+func TestPrelude(t *testing.T) {
+	opts := eval.DefaultOptions()
+	opts.Prelude = `
+import "strings"
+import "os"
+
+const greeting = "hello"
+
+func shout(s string) string { return strings.ToUpper(s) + "!" }
+
+func env() string { return filepath.Base(os.Args[0]) }
+`
+	// os isn't used by this snippet; strings is, through shout
+	out, err := eval.EvalWithOptions(`
+            import "math"
+            p shout(greeting), math.Sqrt(4)
+        `, opts)
+	if ts(out) != "HELLO!\n2" || err != "" {
+		t.Errorf("Expected the prelude to be available, got %q and error %q", out, err)
+	}
+
+	opts.Prelude = "func broken() int {\n\treturn undefinedName\n}"
+	_, err = eval.EvalWithOptions(`p 1`, opts)
+	if !strings.Contains(err, "prelude:2: undefined: undefinedName") {
+		t.Errorf("Expected an error in the prelude, got %q", err)
+	}
+}
+
+func TestLoadPrelude(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "prelude.go")
+	if err := os.WriteFile(name, []byte("func double(i int) int { return 2 * i }\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GORE_PRELUDE", name)
+	prelude, err := eval.LoadPrelude()
+	if err != nil || !strings.Contains(prelude, "func double") {
+		t.Errorf("Expected the prelude from $GORE_PRELUDE, got %q and error %v", prelude, err)
+	}
+
+	t.Setenv("GORE_PRELUDE", "")
+	t.Setenv("HOME", t.TempDir())
+	if prelude, err = eval.LoadPrelude(); prelude != "" || err != nil {
+		t.Errorf("Expected no prelude without ~/.gorerc, got %q and error %v", prelude, err)
+	}
+}
+
+// Brackets are counted wherever they are on a line, not just at its ends
+func TestMidLineBrackets(t *testing.T) {
+	code := `
+            x := 3
+            if x > 2 { fmt.Println("big") }
+            f := func(i int) int { return i * 2 }; fmt.Println(f(x))
+            func g() (int, error) { return 1, nil }
+            type pair struct{ a, b int }
+            p len(fmt.Sprint(g())), strings.Count("(((", "("), pair{}
+        `
+	out, err := eval.Eval(code)
+	if out != "big\n6\n7\n3\n{a:0 b:0}\n" || err != "" {
+		t.Errorf("Expected the snippet to run, got %q and error %q", out, err)
+	}
+
+	_, _, _, perr := eval.Partition("x := foo(); y := bar{\n")
+	if e, ok := perr.(eval.EvalError); !ok || e.Line != 1 {
+		t.Errorf("Expected an unclosed bracket on line 1, got %v", perr)
+	}
+}
+
+func TestInferImports(t *testing.T) {
+	for code, expected := range map[string]string{
+		`p strings.ToUpper("a"), math.Pi`:               "math strings",
+		"import \"os\"\nos.Exit(json.Valid(nil))":       "encoding/json",
+		"time := 1\np time":                             "",
+		"e os.Chdir(\"/\")\nfunc f() { fmt.Println() }": "fmt os",
+		"if true {": "",
+	} {
+		if got := strings.Join(eval.InferImports(code), " "); got != expected {
+			t.Errorf("Expected %q to import %q, got %q", code, expected, got)
+		}
+	}
+}
+
+// A line is split into chunks of text, strings and comments, and packages are inferred from
+// each text chunk in turn, so they have to be found on either side of a string or a comment
+func TestInferAcrossChunks(t *testing.T) {
+	for code, expected := range map[string]string{
+		`s := fmt.Sprintf("%s", x) + strings.Repeat("-", 3)`:      "fmt strings",
+		`s := "a" + strings.Repeat("b", 2) + "c" + path.Base(y)`:  "path strings",
+		"b := 'x' == bytes.ToLower(s)[0] && unicode.IsUpper('y')": "bytes unicode",
+		"x := `a\nb` + strconv.Itoa(os.Getpid())":                 "os strconv",
+		"f(1) /* sort.Strings */ + math.Abs(y) // json.Valid":     "math",
+		`x := fmt.Sprint("strings.Repeat")`:                       "fmt",
+	} {
+		if got := strings.Join(eval.InferImports(code), " "); got != expected {
+			t.Errorf("Expected %q to import %q, got %q", code, expected, got)
+		}
+	}
+	check(t, `p fmt.Sprintf("%s", "a") + strings.Repeat("b", 2)`, "abb", "")
+}
+
+func TestPartition(t *testing.T) {
+	topLevel, nonTopLevel, imports, err := eval.Partition(`
+            func hello() { fmt.Println(strings.ToUpper("hello")) }
+            hello()
+        `)
+	if err != nil || !strings.Contains(topLevel, "//line :2\n") || !strings.Contains(topLevel, "func hello()") ||
+		!strings.Contains(nonTopLevel, "//line :3\n            hello()") || strings.Contains(nonTopLevel, "func") {
+		t.Errorf("Expected the func at the top level and the call in main, got\n%s\nand\n%s\nerror %v", topLevel, nonTopLevel, err)
+	}
+	if strings.Join(imports, " ") != "fmt strings" {
+		t.Errorf("Expected fmt and strings to be inferred, got %v", imports)
+	}
+
+	_, _, _, err = eval.Partition("x := 1\nif x > 0 {\n")
+	if e, ok := err.(eval.EvalError); !ok || e.Line != 2 || !strings.Contains(e.Msg, "not closed") {
+		t.Errorf("Expected an error for the unclosed bracket on line 2, got %#v", err)
+	}
+}
+
+func TestTestFuncs(t *testing.T) {
+	res := eval.Evaluate(context.Background(), `
+            func TestUpper(t *testing.T) {
+                if strings.ToUpper("a") != "A" {
+                    t.Error("wrong")
+                }
+            }
+            func TestLower(t *testing.T) {
+                t.Log("logged")
+                if strings.ToLower("A") != "b" {
+                    t.Error("wrong on purpose")
+                }
+            }
+            func Testify() {}
+        `, eval.DefaultOptions())
+	for _, expected := range []string{"--- PASS: TestUpper", ":8: logged", ":10: wrong on purpose", "--- FAIL: TestLower", "\nFAIL\n"} {
+		if !strings.Contains(res.Out, expected) {
+			t.Errorf("Expected the test output to contain %q, got %+v", expected, res)
+		}
+	}
+	if res.ExitCode != 1 {
+		t.Errorf("Expected the failed test to exit with status 1, got %d", res.ExitCode)
+	}
+
+	check(t, "func TestOK(t *testing.T) {}", "--- PASS: TestOK", "")
+	check(t, "package foo\nimport \"testing\"\nfunc TestFoo(t *testing.T) {}\n", "--- PASS: TestFoo", "")
+	check(t, "func Testify() {}\nTestify()\np \"main\"", "main", "")
+}
+
+func TestBenchmarkFuncs(t *testing.T) {
+	res := eval.Evaluate(context.Background(), `
+            func BenchmarkJoin(b *testing.B) {
+                for i := 0; i < b.N; i++ {
+                    _ = strings.Join([]string{"a", "b"}, ",")
+                }
+            }
+        `, eval.DefaultOptions())
+	for _, expected := range []string{"BenchmarkJoin", "ns/op", "allocs/op", "\nPASS\n"} {
+		if !strings.Contains(res.Out, expected) {
+			t.Errorf("Expected the benchmark output to contain %q, got %+v", expected, res)
+		}
+	}
+	if len(res.Errors) > 0 {
+		t.Errorf("Expected no errors, got %v", res.Errors)
+	}
+}
+
+func TestMaxOutput(t *testing.T) {
+	opts := eval.DefaultOptions()
+	opts.MaxOutput = 10
+	code := `fmt.Print(strings.Repeat("x", 100))`
+	res := eval.Evaluate(context.Background(), code, opts)
+	if expected := "xxxxxxxxxx... [truncated 90 bytes]"; res.Out != expected {
+		t.Errorf("Expected %q, got %+v", expected, res)
+	}
+
+	opts.SeparateOutput = true
+	code = `fmt.Print(strings.Repeat("o", 12)); fmt.Fprint(os.Stderr, "eeeee")`
+	res = eval.Evaluate(context.Background(), code, opts)
+	if expected := "oooooooooo... [truncated 2 bytes]"; res.Stdout != expected {
+		t.Errorf("Expected stdout %q, got %+v", expected, res)
+	}
+	if res.Stderr != "eeeee" {
+		t.Errorf("Expected stderr %q, got %+v", "eeeee", res)
+	}
+
+	res = eval.Evaluate(context.Background(), `fmt.Print(strings.Repeat("x", 100))`, eval.DefaultOptions())
+	if res.Out != strings.Repeat("x", 100) {
+		t.Errorf("Expected the output not to be truncated by default, got %+v", res)
+	}
+}
+
+func TestDebug(t *testing.T) {
+	var debug bytes.Buffer
+	opts := eval.DefaultOptions()
+	opts.Debug = &debug
+	res := eval.Evaluate(context.Background(), "x := 2\np x * 3", opts)
+	if res.Out != "6\n" {
+		t.Errorf("Expected 6, got %+v", res)
+	}
+	for _, expected := range []string{"gore_eval_", "package main", "func main() {", "//line :2\n", "__p(x * 3)"} {
+		if !strings.Contains(debug.String(), expected) {
+			t.Errorf("Expected the generated program to contain %q, got:\n%s", expected, debug.String())
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "ran")
+	code := fmt.Sprintf("os.WriteFile(%q, nil, 0666)\np strings.ToUpper(\"x\")", marker)
+	if errs := eval.Check(code); len(errs) > 0 {
+		t.Errorf("Expected no errors, got %v", errs)
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Errorf("Expected Check not to run the snippet")
+	}
+
+	errs := eval.Check("x := 1\n\np undefinedName")
+	if len(errs) != 2 || !strings.Contains(eval.EvalErrors(errs).Error(), ":3: undefined: undefinedName") {
+		t.Errorf("Expected x to be unused and undefinedName to be undefined, got %v", errs)
+	}
+
+	// The retries still apply
+	if errs := eval.Check("time := 3\nfunc f(time int) {}\np rand.Text(), time"); len(errs) > 0 {
+		t.Errorf("Expected no errors, got %v", errs)
+	}
+}
+
+func TestGoreTmpdir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "not", "yet")
+	t.Setenv("GORE_TMPDIR", dir)
+	check(t, `p "tmpdir"`, "tmpdir\n", "")
+	src, err := os.ReadFile(filepath.Join(dir, "gore_eval.go"))
+	if err != nil || !strings.Contains(string(src), `__p("tmpdir")`) {
+		t.Errorf("Expected the generated program to be saved in %s, got %q, %v", dir, src, err)
+	}
+}
+
+func TestSystemError(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GORE_TMPDIR", filepath.Join(file, "dir")) // can't be created
+	res := eval.Evaluate(context.Background(), `p "not run"`, eval.DefaultOptions())
+	if len(res.Errors) != 1 || res.Errors[0].Kind != eval.SystemError || res.Errors[0].Line != 0 ||
+		!strings.HasPrefix(res.Errors[0].Msg, "Unable to create directory: ") {
+		t.Errorf("Expected a SystemError, got %+v", res)
+	}
+}
+
+func TestEvalFiles(t *testing.T) {
+	files := map[string]string{
+		"helpers.go": `
+            import "strings"
+            func shout(s string) string { return strings.ToUpper(s) + "!" }
+            p "helpers"
+        `,
+		"main.go": `
+            import "strings"
+            p shout(strings.TrimSpace(" hi ")), filepath.Base("/a/b")
+        `,
+	}
+	out, err := eval.EvalFiles(files)
+	if out != "helpers\nHI!\nb\n" || err != "" {
+		t.Errorf("Expected the files to run as one program, got %q, %q", out, err)
+	}
+
+	files["helpers.go"] = "func shout(s string) string {\n\t_ = 1\n\n\treturn undefinedName\n}"
+	if _, err := eval.EvalFiles(files); !strings.Contains(err, "helpers.go:4: undefined: undefinedName") {
+		t.Errorf("Expected an error in helpers.go, got %q", err)
+	}
+
+	files["main.go"] = "\nif true {"
+	if _, err := eval.EvalFiles(files); !strings.HasPrefix(err, "main.go:2: Bracket or paren not closed.") {
+		t.Errorf("Expected an unclosed bracket in main.go, got %q", err)
+	}
+}
+
+func TestTarget(t *testing.T) {
+	code := "var mode uint32\n_ = syscall.GetConsoleMode(0, &mode)"
+	opts := eval.DefaultOptions()
+	opts.CompileOnly = true
+	if res := eval.Evaluate(context.Background(), code, opts); len(res.Errors) == 0 && runtime.GOOS != "windows" {
+		t.Errorf("Expected GetConsoleMode to be undefined on %s", runtime.GOOS)
+	}
+	opts.GOOS, opts.GOARCH = "windows", "amd64"
+	if res := eval.Evaluate(context.Background(), code, opts); len(res.Errors) > 0 {
+		t.Errorf("Expected the snippet to compile for windows, got %v", res.Errors)
+	}
+
+	opts = eval.DefaultOptions()
+	opts.Tags = []string{"gore_a", "gore_b"}
+	res := eval.Evaluate(context.Background(), `
+            info, _ := debug.ReadBuildInfo()
+            for _, s := range info.Settings {
+                if s.Key == "-tags" {
+                    p s.Value
+                }
+            }
+        `, opts)
+	if res.Out != "gore_a,gore_b\n" {
+		t.Errorf("Expected the build tags to be printed, got %+v", res)
+	}
+}
+
+func TestCheckAlias(t *testing.T) {
+	out, err := eval.Eval(`
+            e os.Setenv("GORE_CHECK", "ok")
+            p os.Getenv("GORE_CHECK")
+            e os.Remove("/nonexistent/gore")
+            p "not reached"
+        `)
+	if out != "" || !strings.HasPrefix(err, "ok\nremove /nonexistent/gore: no such file or directory\nexit status 1") {
+		t.Errorf("Expected the failed Remove to end the program, got %q, %q", out, err)
+	}
+
+	// Neither is an alias
+	check(t, "e, err := 1, error(nil)\np e, err\ne = 2\np e", "1\n<nil>\n2\n", "")
+	code := `
+            e := make(chan int, 2)
+            e <- 1
+            n := 1
+            e <- n
+            p len(e)
+        `
+	check(t, code, "2\n", "")
+	code = `
+            e := 0
+            e ++
+            e += 2
+            e |= 8
+            p e
+        `
+	check(t, code, "11\n", "")
+	check(t, "e := []error{nil}\ne [0] = errors.New(\"set\")\np e", "[set]\n", "")
+	check(t, "type box struct{ err error }\ne := box{}\ne .err = errors.New(\"set\")\np e.err", "set\n", "")
+
+	// Only a call that returns just an error can be checked
+	if _, err := eval.Eval(`e os.Open("x")`); !strings.Contains(err, "too many arguments in call to __e") {
+		t.Errorf("Expected a compile error, got %q", err)
+	}
+}
+
+func TestTimeAlias(t *testing.T) {
+	out, err := eval.Eval("time time.Sleep(10 * time.Millisecond)\np \"done\"")
+	if lines := strings.Split(out, "\n"); len(lines) != 3 || !strings.HasSuffix(lines[0], "ms") || lines[1] != "done" || err != "" {
+		t.Errorf("Expected the duration of the Sleep, got %q, %q", out, err)
+	}
+
+	// The variables a timed statement declares are in scope afterwards
+	out, err = eval.Eval("time x, ok := len(\"ab\"), true\ntime y := x * 2\np x, ok, y")
+	if lines := strings.Split(out, "\n"); len(lines) != 6 || lines[2] != "2" || lines[4] != "4" || err != "" {
+		t.Errorf("Expected two durations and the variables, got %q, %q", out, err)
+	}
+
+	// The package, and a variable called time, aren't the alias
+	check(t, "time := 2\np time", "2", "")
+}
+
+func TestEvalBytes(t *testing.T) {
+	for _, c := range []struct{ code, out, err string }{
+		{`p strings.Repeat("ab", 3)`, "ababab\n", ""},
+		{"p 1\np undefinedName", "", ":2: undefined: undefinedName\n"},
+		{"println(\"oops\")\nos.Exit(3)", "", "oops\nexit status 3\n"},
+	} {
+		out, err := eval.EvalBytes([]byte(c.code))
+		if string(out) != c.out || string(err) != c.err {
+			t.Errorf("Evaluating %q, expected %q and error %q, got %q and %q", c.code, c.out, c.err, out, err)
+		}
+	}
+}
+
+func TestShebang(t *testing.T) {
+	check(t, "#!/usr/bin/env gore\np 1", "1\n", "")
+	check(t, "#!/usr/bin/env gore\r\np 1", "1\n", "")
+	check(t, "#!/usr/bin/env gore\npackage main\nfunc main() { println(2) }", "2\n", "")
+	check(t, "#!/usr/bin/env gore", "", "")
+	if _, errs := eval.EvalStructured("#!/usr/bin/env gore\n\np undefinedName"); len(errs) != 1 || errs[0].Line != 3 {
+		t.Errorf("Expected an error on line 3, got %v", errs)
+	}
+	// Only the first line
+	if _, err := eval.Eval("p 1\n#!/usr/bin/env gore"); !strings.Contains(err, ":2:") {
+		t.Errorf("Expected a syntax error on line 2, got %q", err)
+	}
+}
+
+func TestBOM(t *testing.T) {
+	check(t, "\uFEFFp 1\np undefinedName", "", ":2: undefined: undefinedName")
+	check(t, "\uFEFFpackage main\nfunc main() { println(2) }", "2\n", "")
+	check(t, "\uFEFF#!/usr/bin/env gore\np 3", "3\n", "")
+}
+
+// Go identifiers may be any Unicode letters, and strings and comments anything at all
+func TestUnicode(t *testing.T) {
+	code := `
+            /* ünïcödé { */
+            größe, 名前 := 3, "héllo, 世界 {"
+            p größe, 名前, len(名前)
+            // ✓
+            p strings.ToUpper(名前)
+        `
+	check(t, code, "3\nhéllo, 世界 {\n16\nHÉLLO, 世界 {\n", "")
+}
+
+func TestImportDirectives(t *testing.T) {
+	check(t, `
+            //gore:import crypto/rand
+            //gore:import tt html/template
+            b := make([]byte, 4)
+            rand.Read(b)
+            p len(b), tt.HTMLEscapeString("<b>")
+            s := "//gore:import not/a/directive"
+            p s
+        `, "4\n&lt;b&gt;\n//gore:import not/a/directive\n", "")
+
+	// Even without inference, and in spite of the ambiguous name
+	opts := eval.DefaultOptions()
+	opts.InferImports = false
+	res := eval.Evaluate(context.Background(), "//gore:import crypto/rand\np rand.Reader != nil", opts)
+	if res.Out != "true\n" {
+		t.Errorf("Expected crypto/rand to be imported, got %+v", res)
+	}
+
+	if _, errs := eval.EvalStructured("//gore:import strings\n\np undefinedName"); len(errs) != 1 || errs[0].Line != 3 {
+		t.Errorf("Expected just an error on line 3, got %v", errs)
+	}
+
+	// The same for Generate and EvalFiles
+	if src, err := eval.Generate("//gore:import tt html/template\np tt.HTMLEscapeString(\"<b>\")"); err != nil ||
+		!strings.Contains(src, `tt "html/template"`) || strings.Contains(src, "//gore:import") {
+		t.Errorf("Expected the directive to become an import, got %v:\n%s", err, src)
+	}
+	files := map[string]string{"a.go": "//gore:import tt html/template\nfunc esc(s string) string { return tt.HTMLEscapeString(s) }", "b.go": `p esc("<b>")`}
+	if out, err := eval.EvalFiles(files); out != "&lt;b&gt;\n" || err != "" {
+		t.Errorf("Expected the directive to apply to the files, got %q and %q", out, err)
+	}
+}
+
+func TestKeepBinary(t *testing.T) {
+	opts := eval.DefaultOptions()
+	opts.KeepBinary = filepath.Join(t.TempDir(), "hello")
+	res := eval.Evaluate(context.Background(), `p "hello"`, opts)
+	if res.Out != "hello\n" || res.Binary != opts.KeepBinary {
+		t.Fatalf("Expected the program to run and be kept, got %+v", res)
+	}
+	out, err := exec.Command(res.Binary).Output()
+	if string(out) != "hello\n" || err != nil {
+		t.Errorf("Expected the kept binary to print hello, got %q and error %v", out, err)
+	}
+
+	if res = eval.Evaluate(context.Background(), `p undefinedName`, opts); res.Binary != "" {
+		t.Errorf("Expected no binary for a program that doesn't compile, got %q", res.Binary)
+	}
+}
+
+func TestWorkDir(t *testing.T) {
+	code := `
+            os.WriteFile("gore_workdir.txt", nil, 0666)
+            dir, _ := os.Getwd()
+            fmt.Print(dir)
+        `
+	var debug bytes.Buffer
+	opts := eval.DefaultOptions()
+	opts.Debug = &debug
+	res := eval.Evaluate(context.Background(), code, opts)
+	if !strings.Contains(debug.String(), "// running in "+res.Out+"\n") {
+		t.Errorf("Expected the debug output to name the directory %q, got:\n%s", res.Out, debug.String())
+	}
+	if _, err := os.Stat(res.Out); err == nil {
+		t.Errorf("Expected the temp directory %s to be removed", res.Out)
+	}
+	if _, err := os.Stat("gore_workdir.txt"); err == nil {
+		os.Remove("gore_workdir.txt")
+		t.Errorf("Expected the file to be created in the temp directory")
+	}
+
+	opts = eval.DefaultOptions()
+	opts.WorkDir = t.TempDir()
+	res = eval.Evaluate(context.Background(), code, opts)
+	if _, err := os.Stat(filepath.Join(opts.WorkDir, "gore_workdir.txt")); err != nil {
+		t.Errorf("Expected the file to be created in %s, got %+v", opts.WorkDir, res)
+	}
+}
+
+func TestModuleDir(t *testing.T) {
+	dir := t.TempDir()
+	for name, text := range map[string]string{
+		"go.mod":         "module example.com/m\n\ngo 1.21\n",
+		"greet/greet.go": "package greet\n\nfunc Hello() string { return \"hello\" }\n",
+	} {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0777)
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts := eval.DefaultOptions()
+	opts.ModuleDir = dir
+	if res := eval.Evaluate(context.Background(), "p greet.Hello()", opts); res.Out != "hello\n" || len(res.Errors) > 0 {
+		t.Errorf("Expected the module's package to be inferred and built, got %+v", res)
+	}
+	// The package changing is reason enough to rebuild, though the snippet is the same
+	os.WriteFile(filepath.Join(dir, "greet/greet.go"), []byte("package greet\n\nfunc Hello() string { return \"hi\" }\n"), 0666)
+	if res := eval.Evaluate(context.Background(), "p greet.Hello()", opts); res.Out != "hi\n" || len(res.Errors) > 0 {
+		t.Errorf("Expected the changed package to be rebuilt, got %+v", res)
+	}
+	if res := eval.Evaluate(context.Background(), "p greet.Hello()", eval.DefaultOptions()); len(res.Errors) == 0 {
+		t.Errorf("Expected the package to be unknown outside the module, got %+v", res)
+	}
+}
+
+// A module proxy in a directory, serving a stand-in for github.com/dustin/go-humanize, so that
+// fetching it needs no network
+func fakeProxy(t *testing.T) string {
+	root := t.TempDir()
+	dir := filepath.Join(root, "github.com", "dustin", "go-humanize", "@v")
+	os.MkdirAll(dir, 0777)
+	mod := "module github.com/dustin/go-humanize\n"
+	var zipped bytes.Buffer
+	w := zip.NewWriter(&zipped)
+	for name, text := range map[string]string{
+		"go.mod":      mod,
+		"humanize.go": "package humanize\n\nfunc Bytes(n uint64) string { return \"about that much\" }\n",
+	} {
+		f, _ := w.Create("github.com/dustin/go-humanize@v1.0.0/" + name)
+		f.Write([]byte(text))
+	}
+	w.Close()
+	for name, text := range map[string]string{
+		"list":        "v1.0.0\n",
+		"v1.0.0.info": `{"Version":"v1.0.0"}`,
+		"v1.0.0.mod":  mod,
+		"v1.0.0.zip":  zipped.String(),
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestFetchModules(t *testing.T) {
+	goCache, err := exec.Command("go", "env", "GOCACHE").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GOCACHE", strings.TrimSpace(string(goCache))) // or it would move, too
+	cache := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", cache) // for os.UserCacheDir
+	t.Setenv("HOME", cache)
+	t.Setenv("GOPROXY", "file://"+filepath.ToSlash(fakeProxy(t)))
+	t.Setenv("GOMODCACHE", filepath.Join(cache, "mod"))
+	t.Setenv("GOFLAGS", "-modcacherw") // so that the test can clean up
+	t.Setenv("GOSUMDB", "off")
+	opts := eval.DefaultOptions()
+	opts.CacheSize = 0
+	if res := eval.Evaluate(context.Background(), "p humanize.Bytes(82854982)", opts); len(res.Errors) == 0 {
+		t.Errorf("Expected humanize to be unknown without FetchModules, got %+v", res)
+	}
+	opts.FetchModules = true
+	// Not into a module of the user's, though
+	dir := t.TempDir()
+	mod := "module example.com/m\n\ngo 1.21\n"
+	os.WriteFile(filepath.Join(dir, "go.mod"), []byte(mod), 0666)
+	userOpts := opts
+	userOpts.ModuleDir = dir
+	code := "import \"github.com/dustin/go-humanize\"\np humanize.Bytes(82854982)"
+	res := eval.Evaluate(context.Background(), code, userOpts)
+	if text, _ := os.ReadFile(filepath.Join(dir, "go.mod")); string(text) != mod || len(res.Errors) == 0 ||
+		!strings.Contains(res.Errors[len(res.Errors)-1].Msg, "add it with \"go get github.com/dustin/go-humanize\"") {
+		t.Errorf("Expected the user's module to be left alone, got %+v and go.mod\n%s", res, text)
+	}
+	if res := eval.Evaluate(context.Background(), "p humanize.Bytes(82854982)", opts); res.Out != "about that much\n" || len(res.Errors) > 0 {
+		t.Errorf("Expected humanize to be fetched, got %+v", res)
+	}
+	// Fetched once, then inferred like any dependency
+	var debug bytes.Buffer
+	opts.Debug = &debug
+	if res := eval.Evaluate(context.Background(), "p humanize.Bytes(82854982)", opts); res.Out != "about that much\n" ||
+		strings.Count(debug.String(), "package main\n") != 1 {
+		t.Errorf("Expected humanize to be inferred at once, got %+v\n%s", res, debug.String())
+	}
+}
+
+func TestIsComplete(t *testing.T) {
+	for code, complete := range map[string]bool{
+		"":                         true,
+		"x := 1\n":                 true,
+		"func f() {\n":             false,
+		"func f() {\n}\n":          true,
+		"if x {\n\tfoo(1,\n":       false,
+		"s := `raw\n":              false,
+		"s := `raw\nstring`\n":     true,
+		"s := `":                   false,
+		"/* comment\n":             false,
+		"x := 1 /* comment */\n":   true,
+		"/*/":                      false,
+		"s := \"{\"\n":             true,
+		"// {\n":                   true,
+		"p )\n":                    true, // for the compiler to complain about
+		"s := \"unterminated\n":    true,
+		"m := map[string]int{\n\t": false,
+		"foo([]int{\n1,\n})\n":     true,
+		"foo([]int{\n1,\n}\n":      false,
+		"f([1)\n":                  true, // the "[" can't be closed any more
+		"x := f(1]\n":              true,
+		"f(g(\n{)\n":               false,
+	} {
+		if got := eval.IsComplete(code); got != complete {
+			t.Errorf("Expected IsComplete(%q) to be %v", code, complete)
+		}
+	}
+}
+
+func TestUnterminatedRawString(t *testing.T) {
+	_, errs := eval.EvalStructured("x := 1\ns := `raw\n\n p x, s")
+	if len(errs) != 1 || errs[0].Line != 2 || errs[0].Msg != "unterminated raw string literal" {
+		t.Errorf("Expected an unterminated raw string on line 2, got %v", errs)
+	}
+	check(t, "s := `a\nb`\np s", "a\nb\n", "")
+}
+
+func TestErrIncomplete(t *testing.T) {
+	for code, incomplete := range map[string]bool{
+		"if true {\n\tp 1\n": true,
+		"s := `raw\n":        true,
+		"p 1)\n":             false,
+		"p undefinedName\n":  false,
+		"p len([]int{1)\n":   false, // a mismatched bracket is for the compiler
+	} {
+		_, errs := eval.EvalStructured(code)
+		if len(errs) == 0 || errors.Is(errs[0], eval.ErrIncomplete) != incomplete {
+			t.Errorf("Expected %q to be incomplete: %v, got %v", code, incomplete, errs)
+		}
+	}
+	if _, _, _, err := eval.Partition("f(\n"); !errors.Is(err, eval.ErrIncomplete) {
+		t.Errorf("Expected Partition to report incomplete input, got %v", err)
+	}
+}
+
+func TestVet(t *testing.T) {
+	opts := eval.DefaultOptions()
+	opts.Vet = true
+	res := eval.Evaluate(context.Background(), "x := \"a\"\n\nfmt.Printf(\"%d\\n\", x)", opts)
+	if res.Out != "%!d(string=a)\n" || len(res.Errors) > 0 {
+		t.Errorf("Expected the program to run, got %+v", res)
+	}
+	if len(res.Warnings) != 1 || res.Warnings[0].Line != 3 || !strings.Contains(res.Warnings[0].Msg, "format %d has arg x of wrong type string") {
+		t.Errorf("Expected a warning on line 3, got %v", res.Warnings)
+	}
+
+	if res := eval.Evaluate(context.Background(), "p 1", opts); len(res.Warnings) > 0 {
+		t.Errorf("Expected no warnings, got %v", res.Warnings)
+	}
+}
+
+func TestRandSeed(t *testing.T) {
+	opts := eval.DefaultOptions()
+	opts.RandSeed = 42
+	for _, code := range []string{
+		"p rand.Intn(1000000)",
+		"import mr \"math/rand\"\np mr.Intn(1000000)",
+		"func f() int { return rand.Intn(1000000) }\np f()",
+	} {
+		// The sequence for a given seed is part of math/rand's compatibility promise
+		if res := eval.Evaluate(context.Background(), code, opts); res.Out != "72305\n" {
+			t.Errorf("Expected %q to print 72305, got %+v", code, res)
+		}
+	}
+	opts.RandSeed = 7
+	if res := eval.Evaluate(context.Background(), "p rand.Intn(1000000)", opts); res.Out == "72305\n" || len(res.Errors) > 0 {
+		t.Errorf("Expected another number, got %+v", res)
+	}
+	if res := eval.Evaluate(context.Background(), `p "no rand"`, opts); res.Out != "no rand\n" {
+		t.Errorf("Expected no seeding without math/rand, got %+v", res)
+	}
+}
+
+func TestForceColor(t *testing.T) {
+	code := `p os.Getenv("CLICOLOR_FORCE"), os.Getenv("FORCE_COLOR")`
+	opts := eval.DefaultOptions()
+	if res := eval.Evaluate(context.Background(), code, opts); res.Out != "\n\n" {
+		t.Errorf("Expected no color to be forced, got %+v", res)
+	}
+	opts.ForceColor, opts.CaptureValue = true, true
+	if res := eval.Evaluate(context.Background(), code, opts); res.Out != "1\n1\n" {
+		t.Errorf("Expected color to be forced, got %+v", res)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	src, err := eval.Generate(`p math.Pi`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"package main", `import "math"`, "func main() {", "\n//line :1\n\t__p(math.Pi)\n"} {
+		if !strings.Contains(src, expected) {
+			t.Errorf("Expected generated source to contain %q:\n%s", expected, src)
+		}
+	}
+
+	// Helpers, and the packages they use, are left out unless the snippet needs them
+	src, _ = eval.Generate(`println(strings.ToUpper("a"))`)
+	if strings.Contains(src, "func __") || strings.Contains(src, `"fmt"`) {
+		t.Errorf("Expected no helpers and no fmt import:\n%s", src)
+	}
+
+	if _, err = eval.Generate("if true {\n"); err == nil {
+		t.Errorf("Expected an error for an unclosed bracket")
+	}
+}
+
+// A session with several variables generates the same program each time it reruns the same
+// snippet, so the rerun finds the binary in the cache rather than building a new one
+func TestSessionRerunIsCached(t *testing.T) {
+	version, err := exec.Command("go", "env", "GOVERSION").Output()
+	base, e := os.UserCacheDir()
+	if err != nil || e != nil || os.Getenv("GORE_GO") != "" {
+		t.Skip("can't find the binary cache")
+	}
+	dir := filepath.Join(base, "gore", "bin", strings.TrimSpace(string(version)))
+	cached := func() map[string]bool {
+		names := make(map[string]bool)
+		entries, _ := os.ReadDir(dir)
+		for _, entry := range entries {
+			names[entry.Name()] = true
+		}
+		return names
+	}
+	s := eval.NewSession()
+	for i, name := range []string{"d", "a", "c", "b", "e2", "f"} {
+		if _, err := s.Eval(fmt.Sprintf("%s := %d", name, i)); err != "" {
+			t.Fatal(err)
+		}
+	}
+	s.Eval(":vars")
+	before := cached()
+	for i := 0; i < 3; i++ {
+		if out, err := s.Eval(":vars"); !strings.HasPrefix(out, "a int\nb int\n") || err != "" {
+			t.Fatalf("Expected the variables, sorted, got %q and %q", out, err)
+		}
+	}
+	if after := cached(); len(after) != len(before) {
+		t.Errorf("Expected reruns to build nothing new, but the cache went from %d binaries to %d", len(before), len(after))
+	}
+}
+
+// The Scanner that moved to package scanner is still here as it was
+func TestDeprecatedScanner(t *testing.T) {
+	sc := eval.NewScanner("aé/b")
+	sc.ReadRune()
+	mark := sc.Mark()
+	if ch, err := sc.ReadRune(); ch != 'é' || err != nil || sc.Slice(mark) != "é" || sc.Input != "aé/b" {
+		t.Errorf("Expected to read %q, got %q, %v", 'é', ch, err)
+	}
+	sc.UnreadRune()
+	if sc.Pos() != 1 || sc.Reader.Len() != 4 {
+		t.Errorf("Expected to be back at 1, got %d", sc.Pos())
+	}
+}
+
 var ts = strings.TrimSpace
 
 func check(t *testing.T, code string, expected_out string, expected_err string) {
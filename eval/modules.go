@@ -0,0 +1,250 @@
+package eval
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	moduleLock sync.Mutex
+	// the packages available in each directory that's been listed, "" for the current one.
+	// Once built, an index is never changed, only replaced.
+	moduleIndexes = make(map[string]packageIndex)
+	// counts the calls to RefreshPackageIndex, so that a listing that was running during one
+	// isn't kept
+	moduleGeneration int
+)
+
+// The non-standard packages that a module depends on
+type packageIndex struct {
+	pkgs map[string]string // package name -> import path
+	// package names shared by more than one dependency. We refuse to guess between them.
+	ambiguous map[string][]string
+}
+
+// Return the third-party packages available to the module in dir (see Options.ModuleDir), or
+// the current directory if dir is "", keyed by package name. The list is produced by "go list"
+// once per directory and process, or until RefreshPackageIndex; outside a module (or without a
+// go toolchain) it is empty.
+func modulePackages(dir string) map[string]string {
+	pkgs, _ := moduleIndex(dir)
+	return pkgs
+}
+
+// The packages of the module in dir, and the names they share. go list can be slow, so it runs
+// without the lock, and concurrent evaluations needn't wait for it; two of them may list the
+// same directory at once, which does no harm.
+func moduleIndex(dir string) (pkgs map[string]string, ambiguous map[string][]string) {
+	moduleLock.Lock()
+	index, ok := moduleIndexes[dir]
+	generation := moduleGeneration
+	moduleLock.Unlock()
+	if ok {
+		return index.pkgs, index.ambiguous
+	}
+	cmd := exec.Command(goBinary(Options{}), "list", "-deps", "-f", "{{if not .Standard}}{{.Name}} {{.ImportPath}}{{end}}", "./...")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		out = nil
+	}
+	index = parseModulePackages(string(out))
+	moduleLock.Lock()
+	defer moduleLock.Unlock()
+	if generation == moduleGeneration {
+		moduleIndexes[dir] = index
+	}
+	return index.pkgs, index.ambiguous
+}
+
+// RefreshPackageIndex forgets the packages the current module depends on, and those of every
+// Options.ModuleDir, so that evaluations list them again. Call it after changing go.mod, or the
+// current directory. The standard library's packages are listed only once.
+func RefreshPackageIndex() {
+	moduleLock.Lock()
+	defer moduleLock.Unlock()
+	moduleIndexes = make(map[string]packageIndex)
+	moduleGeneration++
+}
+
+// Parse lines of the form "name importpath", skipping things that can't be imported
+func parseModulePackages(list string) (index packageIndex) {
+	index = packageIndex{pkgs: make(map[string]string), ambiguous: make(map[string][]string)}
+	for _, line := range strings.Split(list, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		name, path := fields[0], fields[1]
+		if name == "main" || strings.Contains(path, "/internal/") || strings.Contains(path, "/vendor/") {
+			continue
+		}
+		if _, ok := builtinPackages()[name]; ok {
+			continue // the standard library wins
+		}
+		if paths, ok := index.ambiguous[name]; ok {
+			index.ambiguous[name] = append(paths, path)
+		} else if other, ok := index.pkgs[name]; ok && other != path {
+			delete(index.pkgs, name)
+			index.ambiguous[name] = []string{other, path}
+		} else {
+			index.pkgs[name] = path
+		}
+	}
+	for _, paths := range index.ambiguous {
+		sort.Strings(paths)
+	}
+	return index
+}
+
+var undefinedPat = regexp.MustCompile(`(?m)undefined: (\w+)`)
+
+// If the compiler complains about an undefined name that we deliberately didn't import because
+// several dependencies share it, say so.
+func ambiguityNotes(err string, dir string) (notes string) {
+	seen := make(map[string]bool)
+	_, ambiguous := moduleIndex(dir)
+	for _, match := range undefinedPat.FindAllStringSubmatch(err, -1) {
+		name := match[1]
+		if paths, ok := ambiguous[name]; ok && !seen[name] {
+			seen[name] = true
+			notes += name + " is ambiguous, not imported. Import one of: " + strings.Join(paths, ", ") + "\n"
+		}
+	}
+	return notes
+}
+
+// Well-known third-party packages, by package name, which Options.FetchModules fetches when a
+// snippet refers to them. Names the standard library uses, such as cmp, errors and uuid, are left
+// out.
+var wellKnownPackages = map[string]string{
+	"assert":    "github.com/stretchr/testify/assert",
+	"cobra":     "github.com/spf13/cobra",
+	"color":     "github.com/fatih/color",
+	"decimal":   "github.com/shopspring/decimal",
+	"errgroup":  "golang.org/x/sync/errgroup",
+	"humanize":  "github.com/dustin/go-humanize",
+	"logrus":    "github.com/sirupsen/logrus",
+	"mux":       "github.com/gorilla/mux",
+	"require":   "github.com/stretchr/testify/require",
+	"semver":    "golang.org/x/mod/semver",
+	"spew":      "github.com/davecgh/go-spew/spew",
+	"toml":      "github.com/BurntSushi/toml",
+	"websocket": "github.com/gorilla/websocket",
+	"xxhash":    "github.com/cespare/xxhash/v2",
+	"yaml":      "gopkg.in/yaml.v3",
+	"zap":       "go.uber.org/zap",
+}
+
+var fetchLock sync.Mutex
+
+// With Options.FetchModules, and no ModuleDir, build in the module that packages are fetched
+// into
+func withFetchModule(opts Options) Options {
+	if opts.FetchModules && opts.ModuleDir == "" {
+		opts.ModuleDir = fetchModuleDir(opts)
+	}
+	return opts
+}
+
+// The module that Options.FetchModules fetches packages into, created on first use under
+// os.UserCacheDir, so that a package is only fetched once. Besides go.mod, it holds deps.go,
+// which imports each package fetched so far, so that modulePackages lists them and later
+// snippets infer them like any other dependency.
+func fetchModuleDir(opts Options) string {
+	fetchLock.Lock()
+	defer fetchLock.Unlock()
+	dir, err := fetchModulePath()
+	if err != nil {
+		systemFailure("No directory to fetch modules into", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+		return dir
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		systemFailure("Unable to create module directory", err)
+	}
+	cmd := exec.Command(goBinary(opts), "mod", "init", "gore_eval")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		systemFailure("Unable to create go.mod", errors.New(strings.TrimSpace(string(out))))
+	}
+	return dir
+}
+
+// Where fetchModuleDir keeps its module
+func fetchModulePath() (string, error) {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(base, "gore", "mod"), nil
+}
+
+// Whether dir is the module that fetchModuleDir creates. Any other module belongs to the user,
+// and gore leaves its go.mod alone.
+func isFetchModule(dir string) bool {
+	fetchDir, err := fetchModulePath()
+	if err != nil || dir == "" {
+		return false
+	}
+	dir, _ = filepath.Abs(dir)
+	return dir == fetchDir
+}
+
+var missingPackagePat = regexp.MustCompile(`no required module provides package (\S+?);`)
+
+// With Options.FetchModules, import the well-known packages that the compiler says are
+// undefined, and go get the packages it says no module provides. retry reports whether either
+// happened; having fetched a package is worth a retry even though the source hasn't changed. If
+// go get fails, its output is returned as notes, to explain the compiler's error. Packages are
+// only fetched into gore's own module; a ModuleDir of the user's is left as it is, and the
+// notes say what to add to it instead.
+func fetchPackages(ctx context.Context, err string, pkgsToImport map[string]string, opts Options) (retry bool, notes string) {
+	if !isFetchModule(opts.ModuleDir) {
+		for _, match := range missingPackagePat.FindAllStringSubmatch(err, -1) {
+			notes += match[1] + " is not in the module; add it with \"go get " + match[1] + "\"\n"
+		}
+		return false, notes
+	}
+	for _, match := range undefinedPat.FindAllStringSubmatch(err, -1) {
+		if path, ok := wellKnownPackages[match[1]]; ok {
+			if _, imported := pkgsToImport[path]; !imported {
+				pkgsToImport[path] = ""
+				retry = true
+			}
+		}
+	}
+	fetched := false
+	fetchLock.Lock()
+	defer fetchLock.Unlock()
+	for _, match := range missingPackagePat.FindAllStringSubmatch(err, -1) {
+		path := match[1]
+		out, e := goCommand(ctx, opts, "get", path).CombinedOutput()
+		if e != nil {
+			notes += string(out)
+			continue
+		}
+		deps := filepath.Join(opts.ModuleDir, "deps.go")
+		text, _ := os.ReadFile(deps)
+		if len(text) == 0 {
+			text = []byte("// The packages gore has fetched\npackage main\n\n")
+		}
+		text = append(text, "import _ \""+path+"\"\n"...)
+		if e := os.WriteFile(deps, text, 0644); e != nil {
+			systemFailure("Unable to record fetched package", e)
+		}
+		fetched = true
+	}
+	if fetched {
+		RefreshPackageIndex()
+	}
+	return retry || fetched, notes
+}
@@ -0,0 +1,52 @@
+package eval
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestModulePackages(t *testing.T) {
+	index := parseModulePackages(`
+bar github.com/foo/bar
+utils github.com/a/utils
+utils github.com/b/utils
+main github.com/foo/cmd/tool
+fmt github.com/foo/fmt
+`)
+	if index.pkgs["bar"] != "github.com/foo/bar" {
+		t.Errorf("Expected bar to be inferable, got %v", index.pkgs)
+	}
+	for _, name := range []string{"utils", "main", "fmt"} {
+		if _, ok := index.pkgs[name]; ok {
+			t.Errorf("Expected %s not to be inferable, got %v", name, index.pkgs)
+		}
+	}
+	RefreshPackageIndex()
+	defer RefreshPackageIndex()
+	moduleLock.Lock()
+	moduleIndexes[""] = index
+	moduleLock.Unlock()
+	notes := ambiguityNotes(":3: undefined: utils", "")
+	if !strings.Contains(notes, "utils is ambiguous") || !strings.Contains(notes, "github.com/a/utils, github.com/b/utils") {
+		t.Errorf("Expected a note about ambiguous utils, got %q", notes)
+	}
+}
+
+func TestRefreshPackageIndex(t *testing.T) {
+	moduleLock.Lock()
+	moduleIndexes[""] = packageIndex{pkgs: map[string]string{"bar": "github.com/foo/bar"}}
+	moduleLock.Unlock()
+	RefreshPackageIndex()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, ok := modulePackages("")["bar"]; ok {
+				t.Errorf("Expected the index to be listed again")
+			}
+		}()
+	}
+	wg.Wait()
+}
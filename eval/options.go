@@ -0,0 +1,143 @@
+package eval
+
+import (
+	"io"
+)
+
+// Aliases names the shorthand commands that Eval expands when they begin a statement. An empty
+// name disables that alias.
+type Aliases struct {
+	Print       string // "p a, b" prints each value
+	PrettyPrint string // "pp a, b" prints each value in Go syntax (see Options.PrettyVerb)
+	Dump        string // "d a, b" prints each value as indented JSON
+	Type        string // "t a, b" prints the type of each value
+	TypeValue   string // "tv a, b" prints the type and value of each value
+	Check       string // "e f()" prints the error f returns, if any, and ends the program
+	Time        string // "time f()" runs f() and prints how long it took
+}
+
+var DefaultAliases = Aliases{Print: "p", PrettyPrint: "pp", Dump: "d", Type: "t", TypeValue: "tv", Check: "e", Time: "time"}
+
+// Options control the conveniences Eval provides. Start from DefaultOptions and adjust; note
+// that the zero value disables every alias.
+type Options struct {
+	Aliases Aliases
+	// Have the Print alias print all its values on one line, separated by PrintSeparator (a
+	// space if empty), instead of each on a line of its own
+	PrintInline    bool
+	PrintSeparator string
+	// The fmt verb the Print alias formats each value with, such as "%v" or "%#v". If empty,
+	// $GORE_PRINT_VERB is used, or else "%+v".
+	PrintVerb string
+	// The fmt verb the PrettyPrint alias formats each value with. If empty, "%#v" is used.
+	PrettyVerb string
+	// The number of compiled snippets to keep in the cache under os.UserCacheDir, so that
+	// evaluating the same code again needn't recompile it. 0 disables the cache. Snippets that
+	// import packages outside the standard library are always compiled afresh.
+	CacheSize int
+	// Import the packages the snippet appears to use, such as strings for "strings.ToUpper". If
+	// false, only the packages the snippet imports itself and those in Imports are available,
+	// along with fmt.
+	InferImports bool
+	// Declarations, such as helper functions and imports, to make available to every snippet
+	// (see LoadPrelude). Its imports are dropped when a snippet doesn't use them.
+	Prelude string
+	// Packages to import in addition to the inferred ones, keyed by the name to import them as
+	// ("" for the package's own name)
+	Imports map[string]string
+	// If evaluation fails, add a line to the error listing the packages that were imported
+	// automatically, and those removed after a failed compile
+	Verbose bool
+	// The go command used to build snippets. If empty, $GORE_GO is used, or else "go" from the PATH
+	GoBin string
+	// Extra arguments for "go build", such as "-gcflags=-m"
+	BuildFlags []string
+	// Build with the race detector, so that the program reports the data races it runs into. The
+	// report goes to stderr, like a panic, and is left as it is. Building takes longer.
+	Race bool
+	// Build tags, as with "go build -tags"
+	Tags []string
+	// The platform to build for, as with $GOOS and $GOARCH; empty for the host's. A program built
+	// for another platform usually can't run here, so use CompileOnly.
+	GOOS   string
+	GOARCH string
+	// Don't delete the generated gore_eval_*.go file after building it, or the temp directory
+	// the program ran in
+	KeepTemp bool
+	// If set, the compiled program is also saved to this path, so that it can be profiled or run
+	// again separately (see EvalResult.Binary). It's run all the same.
+	KeepBinary string
+	// The directory to run the program in. If empty, it runs in a new temp directory, so that
+	// the files it creates don't litter the current one; use "." for the current directory.
+	WorkDir string
+	// The directory to run the go command in, which must be inside a Go module. The snippet can
+	// then import that module's packages and its dependencies, as listed in its go.mod, and
+	// those dependencies are inferred from their package names. If empty, the go command runs
+	// in the current directory, which serves just as well if it's inside the module; outside
+	// any module, only the standard library is available. The program itself still runs in
+	// WorkDir.
+	ModuleDir string
+	// If there's no ModuleDir, build in a module of gore's own under os.UserCacheDir instead,
+	// running "go get" for the packages a snippet imports that it doesn't have yet, as well as
+	// for a few well-known packages, such as yaml and humanize, that the snippet refers to. Each is
+	// fetched once, and inferred from then on. This needs network access, and writes to the
+	// module's go.mod, so it's off by default. The go.mod of a ModuleDir is never changed; the
+	// errors say which packages to add to it instead.
+	FetchModules bool
+	// Declare each name the compiler says is undefined as a variable of type interface{}, and
+	// try again, so that a fragment selected from a larger program, which uses variables
+	// declared elsewhere, compiles as far as it can. This is approximate at best: x.Field or
+	// x+1 still fail, and an undefined type can't be stubbed. The names are reported in
+	// EvalResult.Stubbed. Combine it with CompileOnly, since the stubs are all nil.
+	StubUndefined bool
+	// The name of the file the snippet came from, if any. Errors in the snippet, and the stack
+	// traces of panics, then refer to it by name (see EvalError.File), so editors can find them.
+	SourceName string
+	// If set, each program generated from the snippet is written to Debug before it's built,
+	// "//line" comments and all
+	Debug io.Writer
+	// If set, Transform is given each program generated from the snippet, and returns the
+	// program to build in its place, say with tracing added. It's called before Debug sees the
+	// program, and the binary cache is keyed by what it returns.
+	Transform func(src string) string
+	// Run go vet on the program, too, and report what it finds in EvalResult.Warnings. The
+	// program runs regardless.
+	Vet bool
+	// If not 0, seed math/rand with this value, if the program uses it, so that its "random"
+	// numbers are the same every time
+	RandSeed int64
+	// Compile the snippet, but don't run it. ExitCode is then always NotRun (see Check).
+	CompileOnly bool
+	// The program's output goes through pipes, not a terminal, so programs that check usually
+	// leave out color. ForceColor sets CLICOLOR_FORCE=1 and FORCE_COLOR=1 in its environment,
+	// which those that honor the conventions take to mean they should use color anyway.
+	ForceColor bool
+	// Capture the program's stdout and stderr separately (see EvalResult)
+	SeparateOutput bool
+	// If positive, collect at most this many bytes of the program's output (of each stream, with
+	// SeparateOutput), and note how many more were dropped with "... [truncated N bytes]"
+	MaxOutput int
+	// Print the value of each bare expression at the top level of the snippet, as in "2 + 3",
+	// the way other REPLs do
+	AutoPrint bool
+	// Experimental: instead of printing the snippet's last statement, if it's a bare expression,
+	// return its value in EvalResult.Value
+	CaptureValue bool
+	// If either is set, the program's output is written to these as it's produced, instead of
+	// being collected in EvalResult; a nil one discards its output
+	Stdout io.Writer
+	Stderr io.Writer
+	// The program's standard input. If nil, it reads from the null device.
+	Stdin io.Reader
+	// Environment variables to set for the program, in addition to, or instead of, those it
+	// inherits. They don't affect this process's own environment.
+	Env map[string]string
+	// The program's command-line arguments, os.Args[1:]. os.Args[0] is the path of the compiled
+	// binary, a temporary or cached file whose name means nothing.
+	Args []string
+}
+
+// DefaultOptions returns the options used by Eval
+func DefaultOptions() Options {
+	return Options{Aliases: DefaultAliases, CacheSize: 32, InferImports: true}
+}
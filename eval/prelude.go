@@ -0,0 +1,44 @@
+package eval
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// The file name errors in the prelude are reported against
+const preludeFile = "prelude"
+
+// LoadPrelude reads the prelude for Options.Prelude from the file named by $GORE_PRELUDE, or
+// else from ~/.gorerc. If there's no such file, the prelude is empty.
+func LoadPrelude() (string, error) {
+	name := os.Getenv("GORE_PRELUDE")
+	if name == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", nil
+		}
+		name = filepath.Join(home, ".gorerc")
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			return "", nil
+		}
+	}
+	buf, err := os.ReadFile(name)
+	return string(buf), err
+}
+
+// Add the prelude to the snippet's top-level code. It goes after that code, whose imports must
+// come first; order doesn't matter to the other declarations. The prelude's imports become forced
+// imports, so that like inferred ones they're dropped when the snippet doesn't use them, and the
+// packages the prelude refers to are inferred as usual.
+func addPrelude(prelude string, topLevel string, pkgsToImport map[string]string, opts Options) (string, Options) {
+	if prelude == "" {
+		return topLevel, opts
+	}
+	prelude, imports := importDecls(prelude)
+	if _, _, pkgs, err := partition(prelude, opts.ModuleDir); err == nil {
+		for path, alias := range pkgs {
+			pkgsToImport[path] = alias
+		}
+	}
+	return topLevel + "\n//line " + preludeFile + ":1\n" + prelude + "\n", withImports(opts, imports)
+}
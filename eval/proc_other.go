@@ -0,0 +1,11 @@
+//go:build !unix
+
+package eval
+
+import (
+	"os/exec"
+)
+
+// There are no process groups here; cancelling cmd kills only the go command itself.
+func setProcessGroup(cmd *exec.Cmd) {
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package eval
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Run cmd in its own process group, so that cancelling it kills not just "go run" but also the
+// compiled program it spawned.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
@@ -0,0 +1,57 @@
+package eval
+
+import (
+	"fmt"
+)
+
+// ExitCode of a program that never ran to completion, because it failed to compile or the
+// evaluation was cancelled. A package other than main is only compiled, as is any snippet with
+// Options.CompileOnly, so its ExitCode is NotRun even when there are no Errors.
+const NotRun = -1
+
+// An EvalResult is the complete outcome of evaluating a snippet
+type EvalResult struct {
+	// The combined stdout and stderr output of the program, unless it went to Options.Stdout
+	// and Options.Stderr
+	Out string
+	// With Options.SeparateOutput, the program's stdout and stderr, captured separately. Out is
+	// then just their concatenation, since the interleaving is lost.
+	Stdout string
+	Stderr string
+	// Errors that kept the program from running, such as compiler errors
+	Errors []EvalError
+	// With Options.Vet, what go vet found wrong with a program that compiled
+	Warnings []EvalError
+	// The program's exit status, or NotRun
+	ExitCode int
+	// With Options.KeepBinary, where the compiled program was saved, if it compiled
+	Binary string
+	// With Options.StubUndefined, the names that were declared as stubs, sorted
+	Stubbed []string
+	// With Options.CaptureValue, the value of the snippet's last expression, if it got that far
+	Value *Value
+}
+
+// A Value is the result of an expression, as captured by Options.CaptureValue. This is
+// experimental.
+type Value struct {
+	Type string // as printed by %T; for a call with several results, "(int, error)" and so on
+	// The value marshaled with encoding/json, or nil if it can't be, say because it's a func or
+	// a channel. Several results are marshaled as an array.
+	JSON []byte
+	Text string // as printed by p
+}
+
+// Convert a result to what Eval returns: either the output of a successful run, or errors. The
+// output of a program that exits with a non-zero status is an error, as it is for "go run".
+func (res EvalResult) outputAndErrors() (out string, errs []EvalError) {
+	switch {
+	case len(res.Errors) > 0:
+		return "", res.Errors
+	case res.ExitCode != 0 && res.ExitCode != NotRun:
+		// Not parsed like compiler output, which would mangle a stack trace
+		msg := res.Out + fmt.Sprintf("exit status %d", res.ExitCode)
+		return "", []EvalError{{Msg: msg, Kind: RuntimeError}}
+	}
+	return res.Out, nil
+}
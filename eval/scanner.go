@@ -2,13 +2,24 @@ package eval
 
 import (
 	"strings"
+
+	"github.com/theclapp/gore/scanner"
 )
 
+// The scanner has moved to package scanner, along with the chunks it splits code into. What
+// follows is the API this package had before, unchanged, for code that still uses it; gore
+// itself doesn't.
+
+// A Scanner reads runes from a string, and can go back to positions it has marked. Positions
+// count the runes' bytes from the end of Input.
+//
+// Deprecated: use scanner.Scanner, which reads any io.Reader.
 type Scanner struct {
 	Reader *strings.Reader
 	Input  string
 }
 
+// Deprecated: use scanner.NewScanner.
 func NewScanner(text string) *Scanner {
 	reader := strings.NewReader(text)
 	return &Scanner{Reader: reader, Input: text}
@@ -51,3 +62,13 @@ func chk(err error) {
 		panic(err)
 	}
 }
+
+// Deprecated: use scanner.Chunk.
+type Chunk = scanner.Chunk
+
+// Deprecated: use the constants in package scanner.
+const (
+	KSTRING  = scanner.KSTRING
+	KCOMMENT = scanner.KCOMMENT
+	KTEXT    = scanner.KTEXT
+)
@@ -0,0 +1,347 @@
+package eval
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A Session evaluates a sequence of snippets the way a REPL would: variables, types, functions
+// and imports declared by earlier snippets remain visible to later ones. Each call to Eval
+// recompiles and reruns the whole accumulated program, but returns only the output produced by
+// the newest snippet. As in other REPLs, the value of a bare expression is printed (see
+// Options.AutoPrint).
+//
+// Since the programs are cached by their source (see Options.CacheSize), rerunning one that
+// hasn't changed, such as ":vars" twice in a row, doesn't compile it again. Each new snippet
+// does mean a new program, though. In a 50-snippet session, each step took about a quarter of a
+// second, mostly building, and a cached rerun under 10 milliseconds.
+type Session struct {
+	history []string          // snippets that evaluated successfully, in order
+	vars    map[string]bool   // variables declared at the top level of main so far
+	imports map[string]string // packages imported by snippets so far, as for Options.Imports
+	opts    Options           // see NewSessionWithOptions
+}
+
+func NewSession() *Session {
+	return NewSessionWithOptions(DefaultOptions())
+}
+
+// NewSessionWithOptions returns a Session that evaluates each snippet with opts, as Evaluate
+// would, except that AutoPrint is always set. Options.Prelude is added to every program, and
+// Options.Imports are available to every snippet.
+func NewSessionWithOptions(opts Options) *Session {
+	return &Session{vars: make(map[string]bool), imports: make(map[string]string), opts: opts}
+}
+
+// Printed by the accumulated program just before the newest snippet runs, so that the output of
+// earlier snippets can be discarded.
+const sessionMark = "\x00gore-session-mark\x00"
+
+// Like the other helpers, __mark imports os under a name of its own (see buildMain), so that a
+// session can declare an os of its own
+var sessionHelpers = `func __mark() {
+	__os.Stdout.WriteString(` + strconv.Quote(sessionMark) + `)
+	__os.Stderr.WriteString(` + strconv.Quote(sessionMark) + `)
+}
+`
+
+// Eval evaluates code in the context of all snippets previously evaluated in this session. A
+// short variable declaration of a variable the session already knows about, such as a second
+// "x := 6", is treated as the assignment "x = 6". Snippets that fail are forgotten.
+//
+// Two commands describe the session instead: ":vars" lists its variables and their types, and
+// ":type expr" gives the type of expr, without evaluating it.
+func (s *Session) Eval(code string) (out string, err string) {
+	var errs []EvalError
+	switch cmd := strings.TrimSpace(code); {
+	case cmd == ":vars":
+		out, errs = s.showVars(context.Background())
+	case strings.HasPrefix(cmd, ":type "):
+		out, errs = s.showType(context.Background(), strings.TrimPrefix(cmd, ":type "))
+	default:
+		out, errs = s.eval(context.Background(), code)
+	}
+	return out, joinErrors(errs)
+}
+
+// Bind evaluates expr and keeps its value in the session variable name, as though the snippet
+// "var name = (expr)" had been evaluated; name takes the type of expr. If the session already
+// has a variable called name, the value is assigned to it instead. Output is discarded.
+func (s *Session) Bind(name, expr string) error {
+	if !token.IsIdentifier(name) || name == "_" {
+		return EvalErrors{{Msg: fmt.Sprintf("can't bind %q: not a variable name", name)}}
+	}
+	code := "var " + name + " = (" + expr + ")"
+	if s.vars[name] {
+		code = name + " = (" + expr + ")"
+	}
+	if _, errs := s.eval(context.Background(), code); errs != nil {
+		return EvalErrors(errs)
+	}
+	return nil
+}
+
+// Reset forgets everything evaluated so far.
+func (s *Session) Reset() {
+	s.history = nil
+	s.vars = make(map[string]bool)
+	s.imports = make(map[string]string)
+}
+
+func (s *Session) eval(ctx context.Context, code string) (out string, errs []EvalError) {
+	code, imports := importDecls(code)
+	decls := mainDecls(code)
+	code = s.redeclare(code, decls)
+	var names []string
+	for _, d := range decls {
+		names = append(names, d.names...)
+	}
+	opts := s.options(imports)
+	opts.AutoPrint = true
+	code, opts = applyDirectives(code, opts)
+	if out, errs = s.run(ctx, code, names, opts); errs != nil {
+		return "", errs
+	}
+
+	s.history = append(s.history, code)
+	s.imports = opts.Imports
+	for _, name := range names {
+		s.vars[name] = true
+	}
+	return out, nil
+}
+
+// The options to run a snippet with: the session's own, with the packages imported so far, and
+// then imports, besides
+func (s *Session) options(imports map[string]string) Options {
+	opts := s.opts
+	opts.Imports = make(map[string]string)
+	for _, m := range []map[string]string{s.opts.Imports, s.imports, imports} {
+		for name, path := range m {
+			opts.Imports[name] = path
+		}
+	}
+	return opts
+}
+
+// Run code after everything in the history, returning just its own output. names are the
+// variables code declares, which like the session's own mustn't go unused.
+func (s *Session) run(ctx context.Context, code string, names []string, opts Options) (out string, errs []EvalError) {
+	defer func() { // error recovery
+		if e := recover(); e != nil {
+			out = ""
+			errs = []EvalError{recovered(e)}
+		}
+	}()
+	opts = withFetchModule(opts)
+
+	prefix := sessionHelpers + strings.Join(s.history, "\n") + "\n__mark()\n"
+	base := strings.Count(prefix, "\n")
+	src := prefix + code + "\n"
+	// In order, so that rerunning the same program finds its binary in the cache
+	for _, name := range s.varNames() {
+		src += "_ = " + name + "\n"
+	}
+	for _, name := range names {
+		src += "_ = " + name + "\n"
+	}
+
+	src = expandAliases(src, opts.Aliases)
+	topLevel, nonTopLevel, pkgsToImport, e := partition(src, opts.ModuleDir)
+	if e != nil {
+		err := asEvalError(e)
+		err.Line -= base
+		return "", []EvalError{err}
+	}
+	topLevel, opts = addPrelude(opts.Prelude, topLevel, pkgsToImport, opts)
+	res, err := buildAndExec(ctx, topLevel, nonTopLevel, pkgsToImport, opts)
+	res.Out = afterMark(res.Out)
+	if err != "" {
+		res.Errors = parseErrors(err, "")
+	}
+	if out, errs = res.outputAndErrors(); errs != nil {
+		for i := range errs {
+			if errs[i].Line > base {
+				errs[i].Line -= base
+			} else {
+				errs[i].Line = 0 // can only be in code that compiled before
+			}
+		}
+		return "", errs
+	}
+	return out, nil
+}
+
+// List the session's variables and their types, one "name type" per line, sorted by name
+func (s *Session) showVars(ctx context.Context) (out string, errs []EvalError) {
+	code := ""
+	for _, name := range s.varNames() {
+		code += fmt.Sprintf("__fmt.Printf(\"%%s %%T\\n\", %q, %s)\n", name, name) // in case fmt is shadowed
+	}
+	return s.run(ctx, code, nil, s.options(nil))
+}
+
+// The session's variables, sorted
+func (s *Session) varNames() []string {
+	names := make([]string, 0, len(s.vars))
+	for name := range s.vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// The compiler tells us the type of an expression when it can't be assigned to a variable of a
+// type nobody would use; see showType
+const typeProbe = "struct{__goreType struct{}}"
+
+var typeProbePats = []*regexp.Regexp{
+	regexp.MustCompile(`\((?:variable|value) of (?:\w+ )?type (.*)\) (?:as ` + regexp.QuoteMeta(typeProbe) + `|in single-value context)`),
+	regexp.MustCompile(`\((untyped \w+) constant.*\) as ` + regexp.QuoteMeta(typeProbe)),
+	regexp.MustCompile(`^cannot use (nil) as ` + regexp.QuoteMeta(typeProbe)),
+}
+
+// Report the type of expr. Rather than run code that might have side effects, compile a program
+// that assigns expr to a variable of another type, and find the type in the compiler's complaint.
+func (s *Session) showType(ctx context.Context, expr string) (out string, errs []EvalError) {
+	_, errs = s.run(ctx, "var _ "+typeProbe+" = "+expr, nil, s.options(nil))
+	for _, e := range errs {
+		for _, r := range typeProbePats {
+			if m := r.FindStringSubmatch(e.Msg); m != nil {
+				if m[1] == "nil" {
+					return "untyped nil\n", nil
+				}
+				return m[1] + "\n", nil
+			}
+		}
+	}
+	if errs == nil {
+		return "", []EvalError{{Msg: "can't tell the type of " + expr}}
+	}
+	return "", errs
+}
+
+// Discard output produced before the newest snippet started running
+func afterMark(output string) string {
+	if i := strings.LastIndex(output, sessionMark); i >= 0 {
+		return output[i+len(sessionMark):]
+	}
+	return output
+}
+
+// A mainDecl is a variable declaration at the top level of main
+type mainDecl struct {
+	line   int      // line in the snippet
+	names  []string // declared names, excluding "_"
+	define bool     // a short variable declaration, name := value
+}
+
+// Find the variables code declares at the top level of main. Nested declarations are out of
+// scope for later snippets and are ignored. If code doesn't parse, the compiler will explain
+// why soon enough; we just return nothing.
+func mainDecls(code string) (decls []mainDecl) {
+	defer func() {
+		if e := recover(); e != nil {
+			decls = nil
+		}
+	}()
+	topLevel, nonTopLevel, pkgsToImport, e := partition(expandAliases(code, DefaultAliases), "")
+	if e != nil {
+		return nil
+	}
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", buildMain(topLevel, nonTopLevel, pkgsToImport, DefaultOptions()), 0)
+	if err != nil {
+		return nil
+	}
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Name.Name != "main" || fn.Recv != nil {
+			continue
+		}
+		for _, stmt := range fn.Body.List {
+			d := mainDecl{line: fset.Position(stmt.Pos()).Line}
+			switch stmt := stmt.(type) {
+			case *ast.AssignStmt:
+				if stmt.Tok != token.DEFINE {
+					continue
+				}
+				d.define = true
+				for _, lhs := range stmt.Lhs {
+					// __stop1 and the like are the time alias's (see expandAliases)
+					if id, ok := lhs.(*ast.Ident); ok && id.Name != "_" && !strings.HasPrefix(id.Name, "__") {
+						d.names = append(d.names, id.Name)
+					}
+				}
+			case *ast.DeclStmt:
+				gen, ok := stmt.Decl.(*ast.GenDecl)
+				if !ok || gen.Tok != token.VAR {
+					continue
+				}
+				for _, spec := range gen.Specs {
+					for _, id := range spec.(*ast.ValueSpec).Names {
+						if id.Name != "_" {
+							d.names = append(d.names, id.Name)
+						}
+					}
+				}
+			default:
+				continue
+			}
+			decls = append(decls, d)
+		}
+	}
+	return decls
+}
+
+// Remove the import declarations from code, returning the packages they import, keyed by the
+// name they're imported as. The session imports them in every later program, where, like inferred
+// ones, they're dropped whenever nothing uses them; left in the history, an import that the
+// following snippets don't use would be an error. The lines the declarations were on are left
+// blank, so that line numbers don't change.
+func importDecls(code string) (stripped string, imports map[string]string) {
+	defer func() {
+		if e := recover(); e != nil {
+			stripped, imports = code, nil
+		}
+	}()
+	topLevel, _, _, e := partition(code, "")
+	if e != nil {
+		return code, nil
+	}
+	lines := strings.Split(code, "\n")
+	imports = make(map[string]string)
+	for _, imp := range userImports(topLevel) {
+		imports[imp.name] = imp.path
+		for line := imp.first; line <= imp.last && line <= len(lines); line++ {
+			lines[line-1] = ""
+		}
+	}
+	return strings.Join(lines, "\n"), imports
+}
+
+// Turn "x := 6" into "x = 6" when every variable on the left was declared by an earlier snippet;
+// Go would otherwise complain that there are no new variables on the left side of :=.
+func (s *Session) redeclare(code string, decls []mainDecl) string {
+	lines := strings.Split(code, "\n")
+	for _, d := range decls {
+		if !d.define || len(d.names) == 0 || d.line < 1 || d.line > len(lines) {
+			continue
+		}
+		known := true
+		for _, name := range d.names {
+			known = known && s.vars[name]
+		}
+		if known && strings.Count(lines[d.line-1], ":=") == 1 {
+			lines[d.line-1] = strings.Replace(lines[d.line-1], ":=", "=", 1)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
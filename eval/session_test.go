@@ -0,0 +1,138 @@
+package eval_test
+
+import (
+	"github.com/theclapp/gore/eval"
+	"testing"
+)
+
+// feed each snippet to a session, checking the output and error of each one
+func checkSession(t *testing.T, s *eval.Session, steps ...[3]string) {
+	for _, step := range steps {
+		out, err := s.Eval(step[0])
+		if ts(out) != ts(step[1]) {
+			t.Errorf("Evaluating %q: expected output\n%s\nInstead got:\n%s\n", step[0], step[1], out)
+		}
+		if ts(err) != ts(step[2]) {
+			t.Errorf("Evaluating %q: expected error\n%s\nInstead got:\n%s\n", step[0], step[2], err)
+		}
+	}
+}
+
+func TestSession(t *testing.T) {
+	checkSession(t, eval.NewSession(),
+		[3]string{`x := 5`, "", ""},
+		[3]string{`p x`, "5", ""},
+		[3]string{`func double(i int) int { return 2 * i }`, "", ""},
+		[3]string{`p double(x)`, "10", ""},
+		[3]string{`x := 6`, "", ""}, // redeclaration is a reassignment
+		[3]string{`p x`, "6", ""},
+		[3]string{`p y`, "", ":1: undefined: y"},
+		[3]string{`p strings.Repeat("a", x)`, "aaaaaa", ""},
+		[3]string{`x * 7`, "42", ""}, // bare expressions are printed
+	)
+}
+
+// The session's own helpers don't depend on the name os
+func TestSessionShadowsOs(t *testing.T) {
+	checkSession(t, eval.NewSession(),
+		[3]string{`type os struct{ name string }`, "", ""},
+		[3]string{`p os{"mine"}`, "{name:mine}", ""},
+		[3]string{`x := os{"again"}`, "", ""},
+		[3]string{`p x.name`, "again", ""},
+	)
+}
+
+// :vars doesn't depend on the name fmt either
+func TestSessionShadowsFmt(t *testing.T) {
+	checkSession(t, eval.NewSession(),
+		[3]string{`fmt := 1`, "", ""},
+		[3]string{`:vars`, "fmt int", ""},
+	)
+	checkSession(t, eval.NewSession(),
+		[3]string{`import fmt "strings"`, "", ""},
+		[3]string{`s := fmt.ToUpper("a")`, "", ""},
+		[3]string{`:vars`, "s string", ""},
+	)
+}
+
+func TestSessionImports(t *testing.T) {
+	checkSession(t, eval.NewSession(),
+		[3]string{`import "os"`, "", ""}, // not an error, though nothing uses os yet
+		[3]string{`p 1`, "1", ""},
+		[3]string{`func args() int { return len(os.Args) }`, "", ""},
+		[3]string{`p 2`, "2", ""}, // os is still imported for args
+		[3]string{`p args()`, "1", ""},
+		[3]string{"import (\n\trnd \"math/rand\"\n)\np rnd.New(rnd.NewSource(1)).Intn(1)\np undefinedName", "", ":5: undefined: undefinedName"},
+		[3]string{"import rnd \"math/rand\"\np rnd.New(rnd.NewSource(1)).Intn(1)", "0", ""},
+		[3]string{"//gore:import tt html/template\np tt.HTMLEscapeString(\"<b>\")", "&lt;b&gt;", ""},
+		[3]string{`p tt.HTMLEscapeString("&")`, "&amp;", ""}, // and remembered, like an import
+	)
+}
+
+func TestSessionCommands(t *testing.T) {
+	checkSession(t, eval.NewSession(),
+		[3]string{`:vars`, "", ""},
+		[3]string{`type point struct{ x, y int }`, "", ""},
+		[3]string{`x, pt := 5, point{1, 2}`, "", ""},
+		[3]string{`var err error = fmt.Errorf("oops")`, "", ""},
+		[3]string{`:vars`, "err *errors.errorString\npt main.point\nx int", ""},
+		[3]string{`:type pt`, "point", ""},
+		[3]string{`:type 1.5 * 2`, "untyped float", ""},
+		[3]string{`:type x * 2.5`, "", ":1: 2.5 (untyped float constant) truncated to int"},
+		[3]string{`:type err`, "error", ""},
+		[3]string{`:type strconv.Atoi("1")`, "(int, error)", ""},
+		[3]string{`:type panic("not evaluated")`, "", ":1: panic(\"not evaluated\") (no value) used as value"},
+		[3]string{`:type nil`, "untyped nil", ""},
+	)
+}
+
+func TestSessionReset(t *testing.T) {
+	s := eval.NewSession()
+	checkSession(t, s, [3]string{`x := 5`, "", ""})
+	s.Reset()
+	checkSession(t, s, [3]string{`p x`, "", ":1: undefined: x"})
+}
+
+// A timed declaration declares a variable of the session's, and only that
+func TestSessionTime(t *testing.T) {
+	s := eval.NewSession()
+	for _, code := range []string{`time x := 5`, `time x := x + 1`, `time y := x`} {
+		if _, err := s.Eval(code); err != "" {
+			t.Errorf("Evaluating %q: expected no error, got %q", code, err)
+		}
+	}
+	checkSession(t, s, [3]string{`:vars`, "x int\ny int", ""}, [3]string{`p x, y`, "6\n6", ""})
+}
+
+func TestSessionBind(t *testing.T) {
+	s := eval.NewSession()
+	if err := s.Bind("words", `strings.Fields("a b c")`); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	checkSession(t, s, [3]string{`p len(words)`, "3", ""})
+	if err := s.Bind("words", `[]string{"d"}`); err != nil {
+		t.Fatalf("Expected no error rebinding words, got %v", err)
+	}
+	checkSession(t, s, [3]string{`p words`, "[d]", ""})
+	if err := s.Bind("n", "undefinedName"); err == nil || err.Error() != ":1: undefined: undefinedName" {
+		t.Errorf("Expected an undefined name error, got %v", err)
+	}
+	if err := s.Bind("1x", "1"); err == nil {
+		t.Errorf("Expected an error for a bad name")
+	}
+	checkSession(t, s, [3]string{`p n`, "", ":1: undefined: n"})
+}
+
+func TestSessionWithOptions(t *testing.T) {
+	opts := eval.DefaultOptions()
+	opts.Prelude = "func twice(n int) int { return 2 * n }"
+	opts.Imports = map[string]string{"tt": "html/template"}
+	opts.Aliases.Print = "show"
+	checkSession(t, eval.NewSessionWithOptions(opts),
+		[3]string{`x := twice(3)`, "", ""},
+		[3]string{`show x`, "6", ""},
+		[3]string{`show tt.HTMLEscapeString("<")`, "&lt;", ""},
+		[3]string{`:vars`, "x int", ""},
+		[3]string{`:type tt.HTMLEscapeString`, "func(s string) string", ""},
+	)
+}
@@ -2,41 +2,197 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"github.com/theclapp/gore/eval"
 	"io"
 	"os"
+	"strings"
 )
 
 func main() {
-	var src string
-	if len(os.Args) > 1 {
-		src = os.Args[1]
-	} else {
-		fmt.Println("Enter one or more lines and hit ctrl-D")
-		src = readStdin()
+	file := flag.String("f", "", "evaluate the contents of `file`")
+	debug := flag.Bool("debug", false, "print the generated program to stderr before running it")
+	vet := flag.Bool("vet", false, "report what go vet finds wrong with the program, too")
+	race := flag.Bool("race", false, "build with the race detector")
+	binary := flag.String("o", "", "save the compiled program to `path`, as well as running it")
+	seed := flag.Int64("seed", 0, "seed math/rand with `n`, so that it's the same every time")
+	color := flag.Bool("color", false, "ask the program for colored output, though it's not writing to a terminal")
+	cwd := flag.Bool("cwd", false, "run in the current directory instead of a temp directory")
+	module := flag.String("module", "", "build in `dir`, inside a Go module, to use that module's dependencies")
+	get := flag.Bool("get", false, "go get the third-party packages the program needs into a module of gore's own")
+	asJSON := flag.Bool("json", false, "print the outcome as a JSON object, for other programs to read")
+	prompt := flag.String("prompt", "gore> ", "the interactive `prompt`")
+	banner := flag.String("banner", "Enter Go statements; ctrl-D to quit", "the `message` shown when gore starts interactively")
+	quiet := flag.Bool("q", false, "leave out the banner and prompts")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: gore [-debug] [-vet] [-race] [-o path] [-seed n] [-color] [-cwd] [-module dir] [-get] [-json] [-prompt prompt] [-banner message] [-q] [-f file | code | file] [arg ...]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	opts := eval.DefaultOptions()
+	prelude, err := eval.LoadPrelude()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	opts.Prelude = prelude
+	if *debug {
+		opts.Debug = os.Stderr
 	}
+	if *cwd {
+		opts.WorkDir = "."
+	}
+	opts.ModuleDir = *module
+	opts.FetchModules = *get
+	opts.Vet = *vet
+	opts.Race = *race
+	opts.RandSeed = *seed
+	opts.KeepBinary = *binary
+	opts.ForceColor = *color
 
-	out, err := eval.Eval(src)
-	if err == "" {
-		fmt.Fprint(os.Stdout, out)
+	var src, name string
+	var args []string // for the program
+	switch {
+	case *file != "":
+		src, name, args = readFile(*file), *file, flag.Args()
+	case flag.NArg() > 0:
+		src = flag.Arg(0)
+		// A lone argument naming an existing file is taken to be that file
+		if info, err := os.Stat(src); err == nil && info.Mode().IsRegular() {
+			src, name = readFile(src), src
+		}
+		args = flag.Args()[1:]
+	case isTerminal(os.Stdin):
+		if *asJSON || *vet {
+			// A session's snippets report only their output and errors
+			fmt.Fprintln(os.Stderr, "gore: -json and -vet need a program, from -f, an argument or a pipe; not the interactive REPL")
+			os.Exit(2)
+		}
+		if *quiet {
+			*banner, *prompt = "", ""
+		}
+		if *banner != "" {
+			fmt.Println(*banner)
+		}
+		repl(*prompt, opts)
+		return
+	default: // piped in; take it all as one program
+		buf, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		src = string(buf)
+	}
+
+	opts.SourceName = name
+	opts.Args = args
+	opts.SeparateOutput = *asJSON
+	res := eval.Evaluate(context.Background(), src, opts)
+	if *asJSON {
+		printJSON(res)
 	} else {
-		fmt.Fprint(os.Stderr, err)
+		printResult(res)
+	}
+	if len(res.Errors) > 0 {
+		os.Exit(1)
+	}
+	if res.ExitCode != eval.NotRun { // a package other than main compiles, but isn't run
+		os.Exit(res.ExitCode) // whatever the program exited with
+	}
+}
+
+func printResult(res eval.EvalResult) {
+	fmt.Fprint(os.Stdout, res.Out)
+	for _, w := range res.Warnings {
+		fmt.Fprintln(os.Stderr, "vet:", w)
+	}
+	for _, e := range res.Errors {
+		fmt.Fprintln(os.Stderr, e)
+	}
+}
+
+// The outcome of an evaluation, as printed by -json
+type jsonResult struct {
+	Stdout   string      `json:"stdout"`
+	Stderr   string      `json:"stderr"`
+	ExitCode int         `json:"exitCode"` // -1 if the program didn't run
+	Errors   []jsonError `json:"errors"`
+	Warnings []jsonError `json:"warnings,omitempty"`
+}
+
+type jsonError struct {
+	Line int    `json:"line"` // 0 if the error isn't in the snippet, as for a panic
+	Col  int    `json:"col,omitempty"`
+	Msg  string `json:"msg"`
+}
+
+func printJSON(res eval.EvalResult) {
+	convert := func(errs []eval.EvalError) []jsonError {
+		converted := []jsonError{}
+		for _, e := range errs {
+			converted = append(converted, jsonError{Line: e.Line, Col: e.Col, Msg: e.Msg})
+		}
+		return converted
+	}
+	out := jsonResult{Stdout: res.Stdout, Stderr: res.Stderr, ExitCode: res.ExitCode, Errors: convert(res.Errors)}
+	if len(res.Warnings) > 0 {
+		out.Warnings = convert(res.Warnings)
+	}
+	buf, err := json.Marshal(out)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println(string(buf))
+}
+
+func readFile(name string) string {
+	buf, err := os.ReadFile(name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	return string(buf)
 }
 
-func readStdin() (buf string) {
+// Read statements from stdin, evaluating each in a session with opts as soon as it's complete,
+// until EOF
+func repl(prompt string, opts eval.Options) {
+	session := eval.NewSessionWithOptions(opts)
 	r := bufio.NewReader(os.Stdin)
+	code := ""
 	for {
-		if line, err := r.ReadString('\n'); err != nil {
-			if err == io.EOF {
-				buf += line
+		switch {
+		case prompt == "": // quiet
+		case code == "":
+			fmt.Print(prompt)
+		default:
+			fmt.Print(strings.Repeat(".", len(strings.TrimRight(prompt, " "))) + " ") // continued
+		}
+		line, err := r.ReadString('\n')
+		code += line
+		if err == nil && !eval.IsComplete(code) {
+			continue
+		}
+		if strings.TrimSpace(code) != "" {
+			out, e := session.Eval(code)
+			fmt.Print(out)
+			fmt.Fprint(os.Stderr, e)
+		}
+		code = ""
+		if err != nil {
+			if err != io.EOF {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			if prompt != "" {
+				fmt.Println() // after the ^D
 			}
-			break
-		} else {
-			buf += line
+			return
 		}
 	}
-	return buf
 }
@@ -0,0 +1,222 @@
+package scanner
+
+import (
+	"errors"
+	"io"
+)
+
+// Chunk kind
+const (
+	KSTRING = iota + 1
+	KCOMMENT
+	KTEXT
+)
+
+// A Chunk is a stretch of text, and is either a comment or a string (possibly multiline), or text by default
+type Chunk struct {
+	Kind  int    // One of the chunk kinds above
+	Text  string // slice of input string
+	NumNL int    // number of new lines embedded in text
+}
+
+// Functions for converting the input string into a series of chunks.
+//====================================================================
+
+// Extract the next chunk from input. In case of an err, we attempt to
+// package whatever's read so far into a chunk. After the final chunk is
+// returned, the subsequent call to NextChunk returns an err=io.EOF indication
+func NextChunk(scanner *Scanner) (chunk Chunk, err error) {
+	// mark the current position. Used by mkChunk to extract a slice from
+	// the input, starting from mark to the current read head. Chunks before
+	// it are done with.
+	scanner.Release()
+	mark := scanner.Mark()
+	ch, _, err := scanner.ReadRune()
+
+	if err != nil {
+		return chunk, err
+	}
+
+	switch ch {
+	case '/':
+		// Is this the start of a single or multi-line comment?
+		ch, _, err = scanner.ReadRune()
+		if err != nil {
+			return mkChunk(mark, scanner, KCOMMENT, 0, err)
+		}
+		switch ch {
+		case '/':
+			return readSingleLineComment(mark, scanner)
+		case '*':
+			return readMultilineComment(mark, scanner)
+		default:
+			return readText(mark, scanner)
+		}
+	case '"':
+		return readString(mark, scanner, ch)
+	case '\'':
+		return readRune(mark, scanner)
+	case '`':
+		return readMultilineString(mark, scanner)
+	case '\n': // empty line
+		return mkChunk(mark, scanner, KTEXT, 1, err)
+	default:
+		return readText(mark, scanner)
+	}
+}
+
+func readSingleLineComment(mark int, scanner *Scanner) (chunk Chunk, err error) {
+	for {
+		ch, _, err := scanner.ReadRune()
+		if err != nil || ch == '\n' { // EOL or EOF or some other error, we'll package up what we have so far
+			return mkChunk(mark, scanner, KCOMMENT, 1, err)
+		}
+	}
+}
+
+func readMultilineComment(mark int, scanner *Scanner) (chunk Chunk, err error) {
+	// "/*" has already been consumed. Read until EOF or until "*/", and count num of lines
+	numLines := 0
+	for {
+		ch, _, err := scanner.ReadRune()
+		if err != nil { // EOF or some other error, we'll package up what we have so far
+			return mkChunk(mark, scanner, KCOMMENT, numLines, err)
+		}
+		switch ch {
+		case '*':
+			ch, _, err = scanner.ReadRune()
+			if err != nil || ch == '/' {
+				return mkChunk(mark, scanner, KCOMMENT, numLines, err)
+			}
+		case '\n':
+			numLines++
+		}
+	}
+}
+
+func readString(mark int, scanner *Scanner, endCh rune) (chunk Chunk, err error) {
+	// Looking for endCh (single or double quote) while taking care of escapes
+	for {
+		ch, _, err := scanner.ReadRune()
+		if err != nil { // EOL or EOF or some other error, we'll package up what we have so far
+			return mkChunk(mark, scanner, KSTRING, 0, err)
+		}
+		if ch == endCh {
+			return mkChunk(mark, scanner, KSTRING, 0, nil)
+		} else if ch == '\\' {
+			scanner.ReadRune() // read past next char
+		} else if ch == '\n' {
+			return chunk, ErrNewlineInString
+		}
+	}
+}
+
+// The errors NextChunk returns for strings that aren't closed
+var (
+	ErrNewlineInString = errors.New("newline in string literal")
+	ErrUnterminatedRaw = errors.New("unterminated raw string literal")
+)
+
+// Read a rune literal: a single character or escape sequence, followed by a closing quote. Like
+// strings, rune literals are KSTRING chunks. A rune literal has a bounded length, so a quote that
+// isn't closed where expected is returned as a one-character KTEXT chunk (and left for the
+// compiler to complain about), rather than swallowing the rest of the line.
+func readRune(mark int, scanner *Scanner) (chunk Chunk, err error) {
+	// The opening quote has been consumed. Count the characters expected before the closing quote
+	ch, _, err := scanner.ReadRune()
+	if err != nil {
+		return mkChunk(mark, scanner, KTEXT, 0, err)
+	}
+	n := 0
+	switch ch {
+	case '\n', '\'':
+		n = -1 // invalid already
+	case '\\':
+		ch, _, err = scanner.ReadRune()
+		switch {
+		case err != nil:
+			n = -1
+		case ch == 'x':
+			n = 2
+		case ch == 'u':
+			n = 4
+		case ch == 'U':
+			n = 8
+		case ch >= '0' && ch <= '7':
+			n = 2
+		}
+	}
+	for ; n > 0; n-- {
+		if ch, _, err = scanner.ReadRune(); err != nil || ch == '\n' || ch == '\'' {
+			n = -1
+			break
+		}
+	}
+	if n == 0 {
+		if ch, _, err = scanner.ReadRune(); err == nil && ch == '\'' {
+			return mkChunk(mark, scanner, KSTRING, 0, nil)
+		}
+	}
+	scanner.Reset(mark + 1) // back to just after the quote
+	return mkChunk(mark, scanner, KTEXT, 0, nil)
+}
+
+func readMultilineString(mark int, scanner *Scanner) (chunk Chunk, err error) {
+	numLines := 0
+	for {
+		ch, _, err := scanner.ReadRune()
+		if err == io.EOF {
+			// There's no escaping a backquote, so this can only be a mistake. Left to the
+			// compiler, the rest of the snippet would be partitioned as a string.
+			return chunk, ErrUnterminatedRaw
+		} else if err != nil { // some other error, we'll package up what we have so far
+			return mkChunk(mark, scanner, KSTRING, 1, err)
+		}
+		switch ch {
+		case '`':
+			return mkChunk(mark, scanner, KSTRING, numLines, nil)
+		case '\n':
+			numLines++
+		}
+	}
+}
+
+func readText(mark int, scanner *Scanner) (chunk Chunk, err error) {
+	// read until EOL or EOF or string or possible beginning of comment
+	for {
+		ch, _, err := scanner.ReadRune()
+		if err != nil { // EOF or some other error, we'll package up what we have so far
+			return mkChunk(mark, scanner, KTEXT, 0, err)
+		}
+		switch ch {
+		case '/':
+			slashMark := scanner.Mark()
+			ch, _, err = scanner.ReadRune()
+			if ch == '*' || ch == '/' {
+				// it is a comment. As in Go itself, "/*" always is, even in "a/*b"; a division
+				// by a dereference needs a space, as in "a / *b"
+				scanner.Reset(slashMark - 1) // The -1 is to unread the original slash as well
+				return mkChunk(mark, scanner, KTEXT, 0, nil)
+			}
+			if err != nil {
+				return mkChunk(mark, scanner, KTEXT, 0, err)
+			}
+			scanner.UnreadRune() // a division; what follows may be a string, a rune or a newline
+		case '`', '"', '\'':
+			scanner.UnreadRune() //  NextChunk will reprocess this character
+			return mkChunk(mark, scanner, KTEXT, 0, nil)
+		case '\n':
+			return mkChunk(mark, scanner, KTEXT, 1, nil)
+		}
+	}
+}
+
+func mkChunk(mark int, scanner *Scanner, kind int, numLines int, err error) (chunk Chunk, e error) {
+	text := scanner.Slice(mark)
+	if len(text) > 0 && err == io.EOF {
+		err = nil // Delay the EOF until this chunk is processed;  Will get an EOF the next time
+	}
+	chunk = Chunk{Text: text, Kind: kind, NumNL: numLines}
+	//fmt.Printf("CHUNK : <<%+v>>\n", chunk)
+	return chunk, err
+}
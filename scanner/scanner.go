@@ -0,0 +1,98 @@
+// Package scanner splits Go source, or a snippet of it, into chunks of comments, strings and
+// the text in between, the way gore does before it infers imports and finds declarations. Editor
+// plugins can use it to treat snippets exactly as gore will.
+package scanner
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// A Scanner reads runes from its input, and can go back to positions it has marked since the
+// last Release. Only the input since then is kept in memory, so a long input needn't be held
+// all at once.
+type Scanner struct {
+	src  io.RuneReader
+	buf  []byte // the input read so far, from offset base on
+	base int
+	pos  int // the offset of the next rune to read
+}
+
+// NewScanner returns a Scanner that reads text
+func NewScanner(text string) *Scanner {
+	return NewReaderScanner(strings.NewReader(text))
+}
+
+// NewReaderScanner returns a Scanner that reads r, buffering it unless it's an io.RuneReader
+func NewReaderScanner(r io.Reader) *Scanner {
+	src, ok := r.(io.RuneReader)
+	if !ok {
+		src = bufio.NewReader(r)
+	}
+	return &Scanner{src: src}
+}
+
+// Mark returns the current position, to pass to Reset or Slice
+func (scanner *Scanner) Mark() int {
+	return scanner.pos
+}
+
+// Reset goes back (or forward) to mark, a position returned by Mark since the last Release
+func (scanner *Scanner) Reset(mark int) {
+	if mark < scanner.base || mark > scanner.base+len(scanner.buf) {
+		panic(fmt.Sprintf("scanner: position %d is not in the buffer", mark))
+	}
+	scanner.pos = mark
+}
+
+// ReadRune returns the next rune and its size in bytes, as an io.RuneReader does
+func (scanner *Scanner) ReadRune() (ch rune, size int, err error) {
+	if i := scanner.pos - scanner.base; i < len(scanner.buf) { // read before, then Reset
+		ch, size := utf8.DecodeRune(scanner.buf[i:])
+		scanner.pos += size
+		return ch, size, nil
+	}
+	ch, size, err = scanner.src.ReadRune()
+	if err != nil {
+		return ch, size, err
+	}
+	scanner.buf = utf8.AppendRune(scanner.buf, ch)
+	scanner.pos = scanner.base + len(scanner.buf)
+	return ch, size, nil
+}
+
+// UnreadRune steps back over the rune before the current position. Unlike that of an
+// io.RuneScanner, it can be called several times in a row, back to the last Release.
+func (scanner *Scanner) UnreadRune() error {
+	_, size := utf8.DecodeLastRune(scanner.buf[:scanner.pos-scanner.base])
+	if size == 0 {
+		return ErrNothingToUnread
+	}
+	scanner.pos -= size
+	return nil
+}
+
+// The error UnreadRune returns at the last Release, before which the input is gone
+var ErrNothingToUnread = errors.New("scanner: nothing to unread")
+
+// Slice returns the input from mark to the current position
+func (scanner *Scanner) Slice(mark int) (s string) {
+	return string(scanner.buf[mark-scanner.base : scanner.pos-scanner.base])
+}
+
+// Pos returns the current position, the offset in bytes of the next rune from the start of the
+// input
+func (scanner *Scanner) Pos() int {
+	return scanner.pos
+}
+
+// Release forgets the input before the current position, which can no longer be returned to
+func (scanner *Scanner) Release() {
+	n := copy(scanner.buf, scanner.buf[scanner.pos-scanner.base:])
+	scanner.buf = scanner.buf[:n]
+	scanner.base = scanner.pos
+}
@@ -0,0 +1,71 @@
+package scanner
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReaderScanner(t *testing.T) {
+	// OneByteReader isn't an io.RuneReader, and splits "é" across reads
+	scanner := NewReaderScanner(iotest.OneByteReader(strings.NewReader("aé/b")))
+	mark := scanner.Mark()
+	for _, expected := range "aé" {
+		if ch, size, err := scanner.ReadRune(); ch != expected || size != len(string(expected)) || err != nil {
+			t.Fatalf("Expected %q, got %q (%d bytes), %v", expected, ch, size, err)
+		}
+	}
+	slash := scanner.Mark()
+	scanner.ReadRune()
+	scanner.ReadRune()
+	scanner.Reset(slash)
+	if s := scanner.Slice(mark); s != "aé" {
+		t.Errorf("Expected %q, got %q", "aé", s)
+	}
+	scanner.UnreadRune()
+	if ch, size, _ := scanner.ReadRune(); ch != 'é' || size != 2 {
+		t.Errorf("Expected to reread %q, got %q", 'é', ch)
+	}
+
+	scanner.Release()
+	mark = scanner.Mark()
+	scanner.ReadRune()
+	scanner.ReadRune()
+	if s := scanner.Slice(mark); s != "/b" || len(scanner.buf) != 2 {
+		t.Errorf("Expected only %q to be buffered, got %q (%q)", "/b", s, scanner.buf)
+	}
+	if _, _, err := scanner.ReadRune(); err != io.EOF {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+	scanner.Release()
+	if err := scanner.UnreadRune(); err != ErrNothingToUnread {
+		t.Errorf("Expected nothing to unread after Release, got %v", err)
+	}
+}
+
+func TestNextChunk(t *testing.T) {
+	scanner := NewScanner("x := \"a//b\" // c\n/* d\n*/ y := `e\nf`")
+	expected := []Chunk{
+		{KTEXT, "x := ", 0},
+		{KSTRING, `"a//b"`, 0},
+		{KTEXT, " ", 0},
+		{KCOMMENT, "// c\n", 1},
+		{KCOMMENT, "/* d\n*/", 1},
+		{KTEXT, " y := ", 0},
+		{KSTRING, "`e\nf`", 1},
+	}
+	for _, want := range expected {
+		if chunk, err := NextChunk(scanner); chunk != want || err != nil {
+			t.Errorf("Expected %+v, got %+v, %v", want, chunk, err)
+		}
+	}
+	if _, err := NextChunk(scanner); err != io.EOF {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+	scanner = NewScanner("x := `a\n")
+	NextChunk(scanner)
+	if _, err := NextChunk(scanner); err != ErrUnterminatedRaw {
+		t.Errorf("Expected ErrUnterminatedRaw, got %v", err)
+	}
+}